@@ -0,0 +1,147 @@
+package influxdbfirehosenozzle
+
+import (
+	influxdbclient "github.com/influxdata/influxdb/client/v2"
+)
+
+const defaultMaxBatchPoints = 5000
+
+// destination identifies the database, retention policy and precision a
+// batch is written with. Points are collected in one batch per destination.
+type destination struct {
+	database        string
+	retentionPolicy string
+	precision       string
+}
+
+// batch is the batch of a destination, along with its size in line protocol
+// if MaxBatchBytes is set.
+type batch struct {
+	points influxdbclient.BatchPoints
+	bytes  int
+}
+
+func destinationOf(bp influxdbclient.BatchPoints) destination {
+	return destination{
+		database:        bp.Database(),
+		retentionPolicy: bp.RetentionPolicy(),
+		precision:       bp.Precision(),
+	}
+}
+
+func (i *InfluxdbFirehoseNozzle) newBatchPoints(d destination) influxdbclient.BatchPoints {
+	bp, _ := influxdbclient.NewBatchPoints(influxdbclient.BatchPointsConfig{
+		Database:         d.database,
+		RetentionPolicy:  d.retentionPolicy,
+		Precision:        d.precision,
+		WriteConsistency: i.config.WriteConsistency,
+	})
+	return bp
+}
+
+// newBatch wraps points in a batch, computing their size if MaxBatchBytes
+// is set.
+func (i *InfluxdbFirehoseNozzle) newBatch(bp influxdbclient.BatchPoints) *batch {
+	b := &batch{points: bp}
+	if i.config.MaxBatchBytes > 0 {
+		for _, pt := range bp.Points() {
+			b.bytes += len(pt.String()) + 1
+		}
+	}
+	return b
+}
+
+// batchFor returns the batch of a destination, creating it if necessary.
+func (i *InfluxdbFirehoseNozzle) batchFor(d destination) *batch {
+	b, ok := i.batches[d]
+	if !ok {
+		b = &batch{points: i.newBatchPoints(d)}
+		i.batches[d] = b
+	}
+	return b
+}
+
+// addToBatch adds a point to the batch of its destination and flushes the
+// batch early once it is full.
+func (i *InfluxdbFirehoseNozzle) addToBatch(r route, pt *influxdbclient.Point) {
+	d := i.destinationFor(r, pt.Name())
+	b := i.batchFor(d)
+	b.points.AddPoint(pt)
+	if i.config.MaxBatchBytes > 0 {
+		b.bytes += len(pt.String()) + 1
+	}
+	if i.batchFull(b) {
+		i.flushFullBatch(d, b)
+	}
+}
+
+// pendingPoints returns the number of points in all batches.
+func (i *InfluxdbFirehoseNozzle) pendingPoints() int {
+	n := 0
+	for _, b := range i.batches {
+		n += len(b.points.Points())
+	}
+	return n
+}
+
+func (i *InfluxdbFirehoseNozzle) maxBatchPoints() int {
+	if i.config.MaxBatchPoints == 0 {
+		return defaultMaxBatchPoints
+	}
+	return int(i.config.MaxBatchPoints)
+}
+
+// batchFull returns true once a batch reaches MaxBatchPoints or
+// MaxBatchBytes.
+func (i *InfluxdbFirehoseNozzle) batchFull(b *batch) bool {
+	if len(b.points.Points()) >= i.maxBatchPoints() {
+		return true
+	}
+	return i.config.MaxBatchBytes > 0 && b.bytes >= int(i.config.MaxBatchBytes)
+}
+
+// flushFullBatch hands a full batch over to the writers before the next
+// tick. If the write queue is full, the batch keeps growing until the next
+// tick flushes it.
+func (i *InfluxdbFirehoseNozzle) flushFullBatch(d destination, b *batch) {
+	select {
+	case i.writeQueue <- queuedBatch{points: b.points}:
+		i.earlyFlushedPoints += len(b.points.Points())
+		delete(i.batches, d)
+	default:
+	}
+}
+
+// splitBatch splits a batch into batches of at most MaxBatchPoints points
+// and MaxBatchBytes bytes.
+func (i *InfluxdbFirehoseNozzle) splitBatch(bp influxdbclient.BatchPoints) []influxdbclient.BatchPoints {
+	maxPoints := i.maxBatchPoints()
+	maxBytes := int(i.config.MaxBatchBytes)
+	points := bp.Points()
+	if len(points) <= maxPoints && maxBytes == 0 {
+		return []influxdbclient.BatchPoints{bp}
+	}
+
+	var batches []influxdbclient.BatchPoints
+	var current influxdbclient.BatchPoints
+	size := 0
+	for _, pt := range points {
+		n := 0
+		if maxBytes > 0 {
+			n = len(pt.String()) + 1
+		}
+		if current == nil || len(current.Points()) >= maxPoints || (maxBytes > 0 && size > 0 && size+n > maxBytes) {
+			current, _ = influxdbclient.NewBatchPoints(influxdbclient.BatchPointsConfig{
+				Database:         bp.Database(),
+				RetentionPolicy:  bp.RetentionPolicy(),
+				Precision:        bp.Precision(),
+				WriteConsistency: bp.WriteConsistency(),
+			})
+			batches = append(batches, current)
+			size = 0
+		}
+		current.AddPoint(pt)
+		size += n
+	}
+	return batches
+}
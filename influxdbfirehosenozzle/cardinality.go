@@ -0,0 +1,166 @@
+package influxdbfirehosenozzle
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	"github.com/joek/influxdb-firehose-nozzle/nozzleconfig"
+)
+
+const (
+	overflowTagValue                = "__overflow__"
+	defaultCardinalityWindowSeconds = 3600
+)
+
+type cardinalityViolation struct {
+	measurement string
+	tag         string
+}
+
+// cardinalityGuard tracks the distinct series per measurement and the
+// distinct values per tag key of a measurement within a time window. Points
+// exceeding the series limit are dropped. Tag values exceeding the value
+// limit are either collapsed to overflowTagValue or dropped.
+type cardinalityGuard struct {
+	maxSeries   int
+	maxValues   int
+	collapse    bool
+	window      time.Duration
+	windowStart time.Time
+	series      map[string]map[string]struct{}
+	values      map[string]map[string]map[string]struct{}
+	limited     map[cardinalityViolation]uint64
+	warned      map[cardinalityViolation]bool
+	log         *gosteno.Logger
+}
+
+func newCardinalityGuard(config *nozzleconfig.NozzleConfig, log *gosteno.Logger) (*cardinalityGuard, error) {
+	switch config.CardinalityOverflowAction {
+	case "", nozzleconfig.CardinalityCollapse, nozzleconfig.CardinalityDrop:
+	default:
+		return nil, fmt.Errorf("Unsupported cardinality overflow action %s", config.CardinalityOverflowAction)
+	}
+	if config.MaxSeriesPerMeasurement == 0 && config.MaxValuesPerTag == 0 {
+		return nil, nil
+	}
+
+	windowSeconds := config.CardinalityWindowSeconds
+	if windowSeconds == 0 {
+		windowSeconds = defaultCardinalityWindowSeconds
+	}
+
+	g := &cardinalityGuard{
+		maxSeries: int(config.MaxSeriesPerMeasurement),
+		maxValues: int(config.MaxValuesPerTag),
+		collapse:  config.CardinalityOverflowAction != nozzleconfig.CardinalityDrop,
+		window:    time.Duration(windowSeconds) * time.Second,
+		limited:   make(map[cardinalityViolation]uint64),
+		log:       log,
+	}
+	g.reset(time.Now())
+	return g, nil
+}
+
+func (g *cardinalityGuard) reset(now time.Time) {
+	g.windowStart = now
+	g.series = make(map[string]map[string]struct{})
+	g.values = make(map[string]map[string]map[string]struct{})
+	g.warned = make(map[cardinalityViolation]bool)
+}
+
+// check returns false if the point has to be dropped. Tag values exceeding
+// the limit are collapsed in place. New tag values and series are only
+// registered once the point is accepted, so dropped points don't count
+// against the limits.
+func (g *cardinalityGuard) check(measurement string, tags map[string]string) bool {
+	now := time.Now()
+	if now.Sub(g.windowStart) >= g.window {
+		g.reset(now)
+	}
+
+	series, ok := g.series[measurement]
+	if !ok {
+		series = make(map[string]struct{})
+		g.series[measurement] = series
+	}
+	key := tagsKey(tags)
+	if _, ok := series[key]; ok {
+		return true
+	}
+
+	newValues := map[string]string{}
+	if g.maxValues > 0 {
+		collapsed := false
+		for k, v := range tags {
+			values := g.tagValues(measurement, k)
+			if _, ok := values[v]; ok {
+				continue
+			}
+			if len(values) < g.maxValues {
+				newValues[k] = v
+				continue
+			}
+			g.violate(cardinalityViolation{measurement: measurement, tag: k}, "Tag %s of measurement %s exceeds %d distinct values, offending value %s", k, measurement, g.maxValues, v)
+			if !g.collapse {
+				return false
+			}
+			tags[k] = overflowTagValue
+			collapsed = true
+		}
+		if collapsed {
+			key = tagsKey(tags)
+		}
+	}
+
+	if g.maxSeries > 0 {
+		if _, ok := series[key]; !ok && len(series) >= g.maxSeries {
+			g.violate(cardinalityViolation{measurement: measurement}, "Measurement %s exceeds %d series, dropping new series", measurement, g.maxSeries)
+			return false
+		}
+		series[key] = struct{}{}
+	}
+	for k, v := range newValues {
+		g.tagValues(measurement, k)[v] = struct{}{}
+	}
+	return true
+}
+
+// tagValues returns the distinct values of a tag key of a measurement.
+func (g *cardinalityGuard) tagValues(measurement, tag string) map[string]struct{} {
+	tagValues, ok := g.values[measurement]
+	if !ok {
+		tagValues = make(map[string]map[string]struct{})
+		g.values[measurement] = tagValues
+	}
+	values, ok := tagValues[tag]
+	if !ok {
+		values = make(map[string]struct{})
+		tagValues[tag] = values
+	}
+	return values
+}
+
+// violate counts a limited point and warns once per window and culprit.
+func (g *cardinalityGuard) violate(v cardinalityViolation, format string, args ...interface{}) {
+	g.limited[v]++
+	if !g.warned[v] {
+		g.warned[v] = true
+		g.log.Warnf(format, args...)
+	}
+}
+
+// addCardinalityMetrics adds the number of limited points per measurement
+// and tag since the last flush to the batch.
+func (i *InfluxdbFirehoseNozzle) addCardinalityMetrics() {
+	if i.cardinality == nil {
+		return
+	}
+	for v, count := range i.cardinality.limited {
+		i.addInternalMetricWithTags("cardinalityLimited", count, map[string]string{
+			"measurement": v.measurement,
+			"tag":         v.tag,
+		})
+	}
+	i.cardinality.limited = make(map[cardinalityViolation]uint64)
+}
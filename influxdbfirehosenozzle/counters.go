@@ -0,0 +1,44 @@
+package influxdbfirehosenozzle
+
+import "time"
+
+// counterStateTTL is how long the last total of a counter is kept for rate
+// computation after the counter was last seen.
+const counterStateTTL = time.Hour
+
+type counterState struct {
+	total    uint64
+	t        time.Time
+	lastSeen time.Time
+}
+
+// counterRate computes the per second rate of a counter series from its
+// previous total. A total lower than the previous one is treated as counter
+// reset, so the counter is assumed to have restarted from zero.
+func (i *InfluxdbFirehoseNozzle) counterRate(name string, tags map[string]string, total uint64, t time.Time) (float64, bool) {
+	key := name + "," + tagsKey(tags)
+	prev, ok := i.counters[key]
+	i.counters[key] = &counterState{total: total, t: t, lastSeen: time.Now()}
+	if !ok {
+		return 0, false
+	}
+
+	seconds := t.Sub(prev.t).Seconds()
+	if seconds <= 0 {
+		return 0, false
+	}
+	if total < prev.total {
+		return float64(total) / seconds, true
+	}
+	return float64(total-prev.total) / seconds, true
+}
+
+// expireCounters forgets counters which have not been seen for counterStateTTL.
+func (i *InfluxdbFirehoseNozzle) expireCounters() {
+	now := time.Now()
+	for key, c := range i.counters {
+		if now.Sub(c.lastSeen) > counterStateTTL {
+			delete(i.counters, key)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package influxdbfirehosenozzle
+
+import (
+	"fmt"
+
+	"github.com/joek/influxdb-firehose-nozzle/nozzleconfig"
+)
+
+const defaultPrecision = "ns"
+
+type writeOverride struct {
+	match           func(string) bool
+	retentionPolicy string
+	precision       string
+}
+
+func newWriteOverrides(overrides []nozzleconfig.WriteOverride) ([]writeOverride, error) {
+	var result []writeOverride
+	for n, o := range overrides {
+		match, err := newStringMatcher(o.Match, o.Measurement)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid write override %d: %s", n, err)
+		}
+		err = checkPrecision(o.Precision)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid write override %d: %s", n, err)
+		}
+		result = append(result, writeOverride{
+			match:           match,
+			retentionPolicy: o.RetentionPolicy,
+			precision:       o.Precision,
+		})
+	}
+	return result, nil
+}
+
+// checkPrecision accepts the precisions supported by both the 1.x and the
+// 2.x write API.
+func checkPrecision(precision string) error {
+	switch precision {
+	case "", "ns", "ms", "s":
+		return nil
+	default:
+		return fmt.Errorf("unsupported precision %s", precision)
+	}
+}
+
+// defaultDestination is the destination of points without override.
+func (i *InfluxdbFirehoseNozzle) defaultDestination() destination {
+	d := destination{
+		database:        i.database(),
+		retentionPolicy: i.config.RetentionPolicy,
+		precision:       i.config.Precision,
+	}
+	if d.precision == "" {
+		d.precision = defaultPrecision
+	}
+	return d
+}
+
+// destinationFor applies the first write override matching a measurement
+// and the route of a point. The retention policy of the route takes
+// precedence over the one of the override.
+func (i *InfluxdbFirehoseNozzle) destinationFor(r route, measurement string) destination {
+	d := i.defaultDestination()
+	for _, o := range i.writeOverrides {
+		if !o.match(measurement) {
+			continue
+		}
+		if o.retentionPolicy != "" {
+			d.retentionPolicy = o.retentionPolicy
+		}
+		if o.precision != "" {
+			d.precision = o.precision
+		}
+		break
+	}
+
+	if r.database != "" {
+		d.database = r.database
+	}
+	if r.retentionPolicy != "" {
+		d.retentionPolicy = r.retentionPolicy
+	}
+	return d
+}
@@ -0,0 +1,370 @@
+package influxdbfirehosenozzle
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/gosteno"
+	influxdbclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/joek/influxdb-firehose-nozzle/nozzleconfig"
+)
+
+// errNoHealthyEndpoint is returned if no endpoint could be written to.
+var errNoHealthyEndpoint = errors.New("No healthy InfluxDB endpoint available")
+
+// endpoint is one of several InfluxDB servers. It tracks its own health: an
+// endpoint failing with a retryable error is skipped until its backoff
+// expires, so a failed server doesn't slow down writes to the others.
+//
+// In mirror mode, an endpoint keeps the batches it missed while other
+// endpoints accepted them, up to maxMissedPoints points. They are written
+// before its next batch.
+type endpoint struct {
+	url             string
+	client          influxdbclient.Client
+	log             *gosteno.Logger
+	slots           chan struct{}
+	backoff         time.Duration
+	maxBackoff      time.Duration
+	maxMissedPoints int
+	catchUpLock     sync.Mutex
+
+	lock         sync.Mutex
+	failures     int
+	retryAt      time.Time
+	lastError    error
+	missed       []influxdbclient.BatchPoints
+	missedPoints int
+	skipped      uint64
+	dropped      uint64
+}
+
+// available returns true if the endpoint is healthy or its backoff expired.
+func (e *endpoint) available(now time.Time) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.failures == 0 || !now.Before(e.retryAt)
+}
+
+func (e *endpoint) healthy() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.failures == 0
+}
+
+func (e *endpoint) write(bp influxdbclient.BatchPoints) error {
+	err := e.client.Write(bp)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err == nil {
+		if e.failures > 0 {
+			e.log.Infof("InfluxDB endpoint %s recovered", e.url)
+		}
+		e.failures = 0
+		e.lastError = nil
+		return nil
+	}
+	if !isRetryableWriteError(err) {
+		return err
+	}
+
+	e.failures++
+	e.lastError = err
+	backoff := e.backoff
+	for n := 1; n < e.failures && backoff < e.maxBackoff; n++ {
+		backoff *= 2
+	}
+	if backoff > e.maxBackoff {
+		backoff = e.maxBackoff
+	}
+	e.retryAt = time.Now().Add(backoff)
+	e.log.Warnf("InfluxDB endpoint %s is unhealthy, retrying in %s: %v", e.url, backoff, err)
+	return err
+}
+
+// writeMirrored writes the missed batches first, so the endpoint receives
+// batches in order. While it is catching up, its writes are serialized.
+func (e *endpoint) writeMirrored(bp influxdbclient.BatchPoints) error {
+	e.catchUpLock.Lock()
+	if e.missedBatches() > 0 {
+		defer e.catchUpLock.Unlock()
+		err := e.catchUp()
+		if err != nil {
+			return err
+		}
+		return e.write(bp)
+	}
+	e.catchUpLock.Unlock()
+	return e.write(bp)
+}
+
+// catchUp writes the missed batches in order. It stops at the first
+// retryable error, batches the endpoint rejects are dropped.
+func (e *endpoint) catchUp() error {
+	for {
+		e.lock.Lock()
+		if len(e.missed) == 0 {
+			e.lock.Unlock()
+			return nil
+		}
+		bp := e.missed[0]
+		e.lock.Unlock()
+
+		err := e.write(bp)
+		if err != nil && isRetryableWriteError(err) {
+			return err
+		}
+		e.lock.Lock()
+		// The batch may have been dropped meanwhile to make room.
+		if len(e.missed) > 0 && e.missed[0] == bp {
+			e.missed = e.missed[1:]
+			e.missedPoints -= len(bp.Points())
+		}
+		e.lock.Unlock()
+		if err != nil {
+			e.drop(bp, err)
+		}
+	}
+}
+
+func (e *endpoint) missedBatches() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return len(e.missed)
+}
+
+// miss keeps a batch which other endpoints accepted for the next write. The
+// oldest missed batches are dropped if the endpoint misses too many points.
+func (e *endpoint) miss(bp influxdbclient.BatchPoints) {
+	atomic.AddUint64(&e.skipped, 1)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.missed = append(e.missed, bp)
+	e.missedPoints += len(bp.Points())
+	for e.missedPoints > e.maxMissedPoints {
+		oldest := e.missed[0]
+		e.missed = e.missed[1:]
+		e.missedPoints -= len(oldest.Points())
+		atomic.AddUint64(&e.dropped, 1)
+		e.log.Errorf("InfluxDB endpoint %s missed more than %d points, dropping %d points written to the other endpoints", e.url, e.maxMissedPoints, len(oldest.Points()))
+	}
+}
+
+// drop drops a batch other endpoints accepted but this endpoint failed to
+// write.
+func (e *endpoint) drop(bp influxdbclient.BatchPoints, err error) {
+	atomic.AddUint64(&e.dropped, 1)
+	e.log.Errorf("Dropping %d points InfluxDB endpoint %s did not receive: %v", len(bp.Points()), e.url, err)
+}
+
+// finish makes a last attempt to write the missed batches, ignoring the
+// backoff, and drops those it can't write.
+func (e *endpoint) finish() {
+	e.catchUpLock.Lock()
+	defer e.catchUpLock.Unlock()
+	err := e.catchUp()
+	if err == nil {
+		return
+	}
+
+	e.lock.Lock()
+	missed := e.missed
+	e.missed = nil
+	e.missedPoints = 0
+	e.lock.Unlock()
+	for _, bp := range missed {
+		e.drop(bp, err)
+	}
+}
+
+// mirroredBatch tracks the endpoints which missed a batch until one endpoint
+// accepted it. Batches no endpoint accepted fail as a whole and are retried
+// by the nozzle, so the endpoints don't keep them.
+type mirroredBatch struct {
+	bp       influxdbclient.BatchPoints
+	lock     sync.Mutex
+	accepted bool
+	misses   []mirrorMiss
+}
+
+type mirrorMiss struct {
+	endpoint *endpoint
+	err      error
+}
+
+// miss records that an endpoint didn't receive the batch, because it was
+// unavailable, busy or the write failed with err.
+func (m *mirroredBatch) miss(e *endpoint, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.accepted {
+		m.resolve(mirrorMiss{endpoint: e, err: err})
+		return
+	}
+	m.misses = append(m.misses, mirrorMiss{endpoint: e, err: err})
+}
+
+func (m *mirroredBatch) accept() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.accepted {
+		return
+	}
+	m.accepted = true
+	for _, miss := range m.misses {
+		m.resolve(miss)
+	}
+	m.misses = nil
+}
+
+func (m *mirroredBatch) resolve(miss mirrorMiss) {
+	if miss.err != nil && !isRetryableWriteError(miss.err) {
+		miss.endpoint.drop(m.bp, miss.err)
+		return
+	}
+	miss.endpoint.miss(m.bp)
+}
+
+// multiClient writes to several endpoints. In mirror mode every batch is
+// written to all available endpoints in parallel and the write succeeds
+// once one endpoint accepted it. Slower endpoints finish in the background.
+// Endpoints which are unavailable, busy with as many writes as there are
+// writers or fail to write the batch keep it for their next write. In
+// failover mode the batch is written to the first available endpoint in the
+// configured order.
+type multiClient struct {
+	mode      string
+	endpoints []*endpoint
+	inFlight  sync.WaitGroup
+}
+
+func (c *multiClient) Write(bp influxdbclient.BatchPoints) error {
+	if c.mode == nozzleconfig.EndpointModeMirror {
+		return c.mirror(bp)
+	}
+	return c.failover(bp)
+}
+
+func (c *multiClient) failover(bp influxdbclient.BatchPoints) error {
+	err := errNoHealthyEndpoint
+	now := time.Now()
+	for _, e := range c.endpoints {
+		if !e.available(now) {
+			continue
+		}
+		err = e.write(bp)
+		if err == nil || !isRetryableWriteError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *multiClient) mirror(bp influxdbclient.BatchPoints) error {
+	m := &mirroredBatch{bp: bp}
+	results := make(chan error, len(c.endpoints))
+	started := 0
+	now := time.Now()
+	for _, e := range c.endpoints {
+		if !e.available(now) {
+			m.miss(e, nil)
+			continue
+		}
+		select {
+		case e.slots <- struct{}{}:
+		default:
+			m.miss(e, nil)
+			continue
+		}
+		started++
+		c.inFlight.Add(1)
+		go func(e *endpoint) {
+			defer c.inFlight.Done()
+			defer func() { <-e.slots }()
+			err := e.writeMirrored(bp)
+			if err == nil {
+				m.accept()
+			} else {
+				m.miss(e, err)
+			}
+			results <- err
+		}(e)
+	}
+
+	err := errNoHealthyEndpoint
+	for n := 0; n < started; n++ {
+		result := <-results
+		if result == nil {
+			return nil
+		}
+		if err == errNoHealthyEndpoint || !isRetryableWriteError(result) {
+			err = result
+		}
+	}
+	return err
+}
+
+// Ping pings the first healthy endpoint.
+func (c *multiClient) Ping(timeout time.Duration) (time.Duration, string, error) {
+	err := errNoHealthyEndpoint
+	for _, e := range c.endpoints {
+		var d time.Duration
+		var version string
+		d, version, err = e.client.Ping(timeout)
+		if err == nil {
+			return d, version, nil
+		}
+	}
+	return 0, "", err
+}
+
+// Query queries the first endpoint which answers.
+func (c *multiClient) Query(q influxdbclient.Query) (*influxdbclient.Response, error) {
+	err := errNoHealthyEndpoint
+	for _, e := range c.endpoints {
+		var resp *influxdbclient.Response
+		resp, err = e.client.Query(q)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// finish waits for the writes in flight and makes a last attempt to write
+// the batches endpoints missed.
+func (c *multiClient) finish() {
+	c.inFlight.Wait()
+	for _, e := range c.endpoints {
+		e.finish()
+	}
+}
+
+func (c *multiClient) Close() error {
+	var err error
+	for _, e := range c.endpoints {
+		if closeErr := e.client.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// addEndpointMetrics adds the health of each endpoint, the number of batches
+// it missed and the number of batches it never received since the last
+// flush.
+func (i *InfluxdbFirehoseNozzle) addEndpointMetrics() {
+	for _, e := range i.endpoints {
+		healthy := uint64(0)
+		if e.healthy() {
+			healthy = 1
+		}
+		tags := map[string]string{"endpoint": e.url}
+		i.addInternalMetricWithTags("endpointHealthy", healthy, tags)
+		i.addInternalMetricWithTags("endpointSkippedBatches", atomic.SwapUint64(&e.skipped, 0), tags)
+		i.addInternalMetricWithTags("endpointDroppedBatches", atomic.SwapUint64(&e.dropped, 0), tags)
+	}
+}
@@ -0,0 +1,126 @@
+package influxdbfirehosenozzle
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/joek/influxdb-firehose-nozzle/nozzleconfig"
+)
+
+// noIncludeMatch is reported as rule of envelopes which did not match any
+// include rule.
+const noIncludeMatch = "no_include_match"
+
+type filterMatcher struct {
+	rule  string
+	field string
+	tag   string
+	match func(string) bool
+}
+
+type envelopeFilter struct {
+	includes []filterMatcher
+	excludes []filterMatcher
+}
+
+func newEnvelopeFilter(rules []nozzleconfig.FilterRule) (*envelopeFilter, error) {
+	f := &envelopeFilter{}
+	for n, rule := range rules {
+		m, err := newFilterMatcher(rule)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter rule %d: %s", n, err)
+		}
+		m.rule = strconv.Itoa(n)
+
+		switch rule.Action {
+		case nozzleconfig.FilterInclude:
+			f.includes = append(f.includes, m)
+		case nozzleconfig.FilterExclude, "":
+			f.excludes = append(f.excludes, m)
+		default:
+			return nil, fmt.Errorf("Invalid filter rule %d: unknown action %s", n, rule.Action)
+		}
+	}
+	return f, nil
+}
+
+func newFilterMatcher(rule nozzleconfig.FilterRule) (filterMatcher, error) {
+	m := filterMatcher{field: rule.Field, tag: rule.Tag}
+	switch rule.Field {
+	case "origin", "name", "deployment", "job":
+	case "tag":
+		if rule.Tag == "" {
+			return m, fmt.Errorf("tag filters need a tag key")
+		}
+	default:
+		return m, fmt.Errorf("unknown field %s", rule.Field)
+	}
+
+	var err error
+	m.match, err = newStringMatcher(rule.Match, rule.Value)
+	return m, err
+}
+
+func newStringMatcher(match, value string) (func(string) bool, error) {
+	switch match {
+	case nozzleconfig.MatchExact, "":
+		return func(s string) bool { return s == value }, nil
+	case nozzleconfig.MatchPrefix:
+		return func(s string) bool { return strings.HasPrefix(s, value) }, nil
+	case nozzleconfig.MatchRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	default:
+		return nil, fmt.Errorf("unknown match type %s", match)
+	}
+}
+
+func (m filterMatcher) matches(envelope *events.Envelope) bool {
+	switch m.field {
+	case "origin":
+		return m.match(envelope.GetOrigin())
+	case "name":
+		return m.match(metricName(envelope))
+	case "deployment":
+		return m.match(envelope.GetDeployment())
+	case "job":
+		return m.match(envelope.GetJob())
+	default:
+		v, ok := envelope.GetTags()[m.tag]
+		return ok && m.match(v)
+	}
+}
+
+// check returns whether an envelope passes the filter and if not, the rule
+// which dropped it.
+func (f *envelopeFilter) check(envelope *events.Envelope) (bool, string) {
+	for _, m := range f.excludes {
+		if m.matches(envelope) {
+			return false, m.rule
+		}
+	}
+	if len(f.includes) == 0 {
+		return true, ""
+	}
+	for _, m := range f.includes {
+		if m.matches(envelope) {
+			return true, ""
+		}
+	}
+	return false, noIncludeMatch
+}
+
+// addFilterMetrics adds the number of filtered envelopes per rule since the
+// last flush to the batch.
+func (i *InfluxdbFirehoseNozzle) addFilterMetrics() {
+	for rule, count := range i.filteredEnvelopes {
+		i.addInternalMetricWithTags("filteredEnvelopes", count, map[string]string{"rule": rule})
+	}
+	i.filteredEnvelopes = make(map[string]uint64)
+}
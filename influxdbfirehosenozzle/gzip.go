@@ -0,0 +1,76 @@
+package influxdbfirehosenozzle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/gosteno"
+)
+
+// gzipEncoder compresses write requests. Servers which can't parse
+// compressed requests answer with 415 or a parse error. The request is then
+// sent again uncompressed, and if that succeeds, compression is turned off
+// for the server.
+type gzipEncoder struct {
+	url      string
+	level    int
+	log      *gosteno.Logger
+	disabled int32
+}
+
+// newGzipEncoder returns an encoder compressing with the given level, or
+// with the default compression if level is 0.
+func newGzipEncoder(addr string, level uint32, log *gosteno.Logger) (*gzipEncoder, error) {
+	if level > gzip.BestCompression {
+		return nil, fmt.Errorf("Unsupported gzip level %d, GzipLevel must range from %d to %d", level, gzip.BestSpeed, gzip.BestCompression)
+	}
+	if level == 0 {
+		return &gzipEncoder{url: addr, level: gzip.DefaultCompression, log: log}, nil
+	}
+	return &gzipEncoder{url: addr, level: int(level), log: log}, nil
+}
+
+// write sends a body using send, compressed unless compression was turned
+// off. A nil encoder sends the body uncompressed.
+func (g *gzipEncoder) write(body []byte, send func(body io.Reader, compressed bool) error) error {
+	if g == nil || atomic.LoadInt32(&g.disabled) == 1 {
+		return send(bytes.NewReader(body), false)
+	}
+
+	var b bytes.Buffer
+	w, err := gzip.NewWriterLevel(&b, g.level)
+	if err != nil {
+		return err
+	}
+	w.Write(body)
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	err = send(&b, true)
+	if !gzipRejected(err) {
+		return err
+	}
+	err = send(bytes.NewReader(body), false)
+	if err == nil && atomic.CompareAndSwapInt32(&g.disabled, 0, 1) {
+		g.log.Warnf("InfluxDB at %s doesn't accept gzip compressed writes, writing uncompressed", g.url)
+	}
+	return err
+}
+
+// gzipRejected returns true for errors of servers which might not support
+// compressed requests.
+func gzipRejected(err error) bool {
+	e, ok := err.(*writeError)
+	if !ok {
+		return false
+	}
+	return e.StatusCode == http.StatusUnsupportedMediaType ||
+		(e.StatusCode == http.StatusBadRequest && strings.Contains(e.Body, "unable to parse"))
+}
@@ -0,0 +1,123 @@
+package influxdbfirehosenozzle
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const defaultReadinessMaxFlushes = 3
+
+// status is the JSON document served on /status.
+type status struct {
+	Firehose         string `json:"firehose"`
+	Ready            bool   `json:"ready"`
+	MessagesReceived uint64 `json:"messagesReceived"`
+	PointsWritten    uint64 `json:"pointsWritten"`
+	PointsDropped    uint64 `json:"pointsDropped"`
+	WriteErrors      uint64 `json:"writeErrors"`
+	Reconnects       uint64 `json:"reconnects"`
+	BatchSize        uint64 `json:"batchSize"`
+	Flushes          uint64 `json:"flushes"`
+	LastWriteFlush   uint64 `json:"lastWriteFlush"`
+	LastError        string `json:"lastError,omitempty"`
+	LastErrorTime    string `json:"lastErrorTime,omitempty"`
+}
+
+// healthAddress returns the address of the health endpoints. The port is
+// HealthPort or $PORT, an empty address disables the endpoints.
+func (i *InfluxdbFirehoseNozzle) healthAddress() string {
+	port := os.Getenv("PORT")
+	if i.config.HealthPort != 0 {
+		port = strconv.Itoa(int(i.config.HealthPort))
+	}
+	if port == "" {
+		return ""
+	}
+	return net.JoinHostPort(i.config.HealthBindAddress, port)
+}
+
+// startHealthServer serves the health endpoints until the returned server
+// is closed.
+func (i *InfluxdbFirehoseNozzle) startHealthServer(addr string) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	i.Log.Infof("Serving health endpoints on %s", l.Addr())
+	server := &http.Server{Handler: i}
+	go server.Serve(l)
+	return server, nil
+}
+
+// ServeHTTP serves /healthz, /readyz and /status. /healthz answers as long
+// as the process is alive. /readyz answers 200 if the nozzle is connected
+// to the firehose and a write to InfluxDB succeeded within the last
+// ReadinessMaxFlushes flushes, 503 otherwise. The nozzle is not ready
+// before its first successful write.
+func (i *InfluxdbFirehoseNozzle) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		rw.Write([]byte("ok\n"))
+	case "/readyz":
+		if !i.ready() {
+			http.Error(rw, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		rw.Write([]byte("ok\n"))
+	case "/status":
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(i.status())
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+func (i *InfluxdbFirehoseNozzle) ready() bool {
+	maxFlushes := uint64(i.config.ReadinessMaxFlushes)
+	if maxFlushes == 0 {
+		maxFlushes = defaultReadinessMaxFlushes
+	}
+	flushes := atomic.LoadUint64(&i.stats.flushes)
+	return atomic.LoadInt32(&i.firehoseConnected) == 1 &&
+		atomic.LoadInt32(&i.hasWritten) == 1 &&
+		flushes-atomic.LoadUint64(&i.stats.lastWriteFlush) <= maxFlushes
+}
+
+func (i *InfluxdbFirehoseNozzle) status() status {
+	s := status{
+		Firehose:         "disconnected",
+		Ready:            i.ready(),
+		MessagesReceived: atomic.LoadUint64(&i.stats.messagesReceived),
+		PointsWritten:    atomic.LoadUint64(&i.stats.pointsWritten),
+		PointsDropped:    atomic.LoadUint64(&i.stats.pointsDropped),
+		WriteErrors:      atomic.LoadUint64(&i.stats.writeErrors),
+		Reconnects:       atomic.LoadUint64(&i.stats.reconnects),
+		BatchSize:        atomic.LoadUint64(&i.stats.batchSize),
+		Flushes:          atomic.LoadUint64(&i.stats.flushes),
+		LastWriteFlush:   atomic.LoadUint64(&i.stats.lastWriteFlush),
+	}
+	if atomic.LoadInt32(&i.firehoseConnected) == 1 {
+		s.Firehose = "connected"
+	}
+
+	i.statusLock.Lock()
+	defer i.statusLock.Unlock()
+	if i.lastError != nil {
+		s.LastError = i.lastError.Error()
+		s.LastErrorTime = i.lastErrorTime.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// recordError keeps the last error for /status.
+func (i *InfluxdbFirehoseNozzle) recordError(err error) {
+	i.statusLock.Lock()
+	defer i.statusLock.Unlock()
+	i.lastError = err
+	i.lastErrorTime = time.Now()
+}
@@ -0,0 +1,97 @@
+package influxdbfirehosenozzle
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type httpAggregateKey struct {
+	route route
+	name  string
+	tags  string
+}
+
+type httpAggregate struct {
+	tags  map[string]string
+	count uint64
+	sum   float64
+	min   float64
+	max   float64
+}
+
+func (i *InfluxdbFirehoseNozzle) aggregateHTTPStartStop(envelope *events.Envelope) error {
+	n, err := i.measurementName(envelope)
+	if err != nil {
+		return err
+	}
+	httpStartStop := envelope.GetHttpStartStop()
+	tags := map[string]string{
+		"deployment":     envelope.GetDeployment(),
+		"application_id": formatUUID(httpStartStop.GetApplicationId()),
+		"peer_type":      httpStartStop.GetPeerType().String(),
+		"status_class":   statusClass(httpStartStop.GetStatusCode()),
+	}
+	i.addTemplateTags(envelope, tags)
+	i.applyRelabeling(envelope, tags)
+
+	key := httpAggregateKey{route: i.route(envelope, tags), name: n, tags: tagsKey(tags)}
+	d := durationMillis(httpStartStop)
+
+	a, ok := i.httpAggregates[key]
+	if !ok {
+		i.httpAggregates[key] = &httpAggregate{tags: tags, count: 1, sum: d, min: d, max: d}
+		return nil
+	}
+	a.count++
+	a.sum += d
+	if d < a.min {
+		a.min = d
+	}
+	if d > a.max {
+		a.max = d
+	}
+	return nil
+}
+
+// addHTTPAggregates adds one point per aggregated app and status class
+// to the batch and starts a new aggregation interval.
+func (i *InfluxdbFirehoseNozzle) addHTTPAggregates() {
+	t := time.Now()
+	for key, a := range i.httpAggregates {
+		fields := map[string]interface{}{
+			"count":           float64(a.count),
+			"duration_ms_sum": a.sum,
+			"duration_ms_min": a.min,
+			"duration_ms_max": a.max,
+		}
+		err := i.addPoint(key.route, key.name, a.tags, fields, t)
+		if err != nil {
+			i.Log.Errorf("Failed to add aggregated HttpStartStop point: %v", err)
+		}
+	}
+	i.httpAggregates = make(map[httpAggregateKey]*httpAggregate)
+}
+
+func durationMillis(httpStartStop *events.HttpStartStop) float64 {
+	return float64(httpStartStop.GetStopTimestamp()-httpStartStop.GetStartTimestamp()) / float64(time.Millisecond)
+}
+
+func statusClass(statusCode int32) string {
+	if statusCode < 100 || statusCode > 999 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+func formatUUID(uuid *events.UUID) string {
+	if uuid == nil {
+		return ""
+	}
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], uuid.GetLow())
+	binary.LittleEndian.PutUint64(b[8:], uuid.GetHigh())
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -4,6 +4,10 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudfoundry/gosteno"
@@ -14,6 +18,11 @@ import (
 	"github.com/joek/influxdb-firehose-nozzle/nozzleconfig"
 )
 
+const defaultMetricPrefixSeparator = "."
+
+// errorsMeasurement is the measurement loggregator Error events are written to.
+const errorsMeasurement = "errors"
+
 // InfluxdbFirehoseNozzle type
 type InfluxdbFirehoseNozzle struct {
 	config                *nozzleconfig.NozzleConfig
@@ -23,8 +32,41 @@ type InfluxdbFirehoseNozzle struct {
 	Consumer              *consumer.Consumer
 	Client                influxdbclient.Client
 	Log                   *gosteno.Logger
-	batchPoints           influxdbclient.BatchPoints
-	totalMessagesReceived uint64
+	batches               map[destination]*batch
+	earlyFlushedPoints    int
+	writeOverrides        []writeOverride
+	routingRules          []routingRule
+	endpoints             []*endpoint
+	httpAggregates        map[httpAggregateKey]*httpAggregate
+	logMessagesInFlush    uint64
+	logMessagesDropped    uint64
+	filter                *envelopeFilter
+	relabeler             *relabeler
+	cardinality           *cardinalityGuard
+	counters              map[string]*counterState
+	filteredEnvelopes     map[string]uint64
+	spool                 *spool
+	spoolLock             sync.Mutex
+	writeQueue            chan queuedBatch
+	writers               sync.WaitGroup
+	writesInFlight        int32
+	writeLock             sync.Mutex
+	retainedBatches       []influxdbclient.BatchPoints
+	writeLatencySum       time.Duration
+	writeLatencyCount     int
+	writeLatencyMax       time.Duration
+	rejectedPoints        map[string]uint64
+	deadLetter            *deadLetterFile
+	stats                 nozzleStats
+	flushLatency          time.Duration
+	slowConsumerAlertedAt time.Time
+	firehoseConnected     int32
+	hasWritten            int32
+	stop                  chan struct{}
+	stopLock              sync.Mutex
+	statusLock            sync.Mutex
+	lastError             error
+	lastErrorTime         time.Time
 }
 
 // AuthTokenFetcher interface
@@ -35,9 +77,14 @@ type AuthTokenFetcher interface {
 // NewInfluxDBFirehoseNozzle creates new InfluxDBFirehoseNozzle
 func NewInfluxDBFirehoseNozzle(config *nozzleconfig.NozzleConfig, tokenFetcher AuthTokenFetcher, Log *gosteno.Logger) *InfluxdbFirehoseNozzle {
 	i := &InfluxdbFirehoseNozzle{
-		config:           config,
-		authTokenFetcher: tokenFetcher,
-		Log:              Log,
+		config:            config,
+		authTokenFetcher:  tokenFetcher,
+		Log:               Log,
+		httpAggregates:    make(map[httpAggregateKey]*httpAggregate),
+		filteredEnvelopes: make(map[string]uint64),
+		counters:          make(map[string]*counterState),
+		batches:           make(map[destination]*batch),
+		rejectedPoints:    make(map[string]uint64),
 	}
 
 	i.Consumer = consumer.New(
@@ -45,19 +92,34 @@ func NewInfluxDBFirehoseNozzle(config *nozzleconfig.NozzleConfig, tokenFetcher A
 		&tls.Config{InsecureSkipVerify: i.config.InsecureSSLSkipVerify},
 		nil)
 
-	i.newBatchPoints()
 	return i
 }
 
 func (i *InfluxdbFirehoseNozzle) createClient() error {
-
-	c, err := influxdbclient.NewHTTPClient(influxdbclient.HTTPConfig{
-		Addr:               i.config.InfluxDbURL,
-		Username:           i.config.InfluxDbUser,
-		Password:           i.config.InfluxDbPassword,
-		UserAgent:          i.config.FirehoseSubscriptionID,
-		InsecureSkipVerify: !i.config.InfluxDbAllowSelfSigned,
-	})
+	var c influxdbclient.Client
+	var err error
+	if i.config.InfluxDbVersion == influxDbVersion2 && i.config.InfluxDbUDPAddress == "" {
+		err = i.checkV2Config()
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case i.config.InfluxDbUDPAddress != "":
+		err = i.checkUDPConfig()
+		if err != nil {
+			return err
+		}
+		i.Log.Infof("Writing to InfluxDB via UDP at %s", i.config.InfluxDbUDPAddress)
+		c, err = influxdbclient.NewUDPClient(influxdbclient.UDPConfig{
+			Addr:        i.config.InfluxDbUDPAddress,
+			PayloadSize: int(i.config.InfluxDbUDPPayloadSize),
+		})
+	case len(i.config.InfluxDbEndpoints) > 0:
+		c, err = i.createMultiClient()
+	default:
+		c, err = i.newClient(i.config.InfluxDbURL, i.config.InfluxDbUser, i.config.InfluxDbPassword, i.config.InfluxDbToken)
+	}
 	if err != nil {
 		fmt.Println("Error creating InfluxDB Client: ", err.Error())
 		return err
@@ -66,68 +128,306 @@ func (i *InfluxdbFirehoseNozzle) createClient() error {
 	return nil
 }
 
+// checkUDPConfig rejects options the UDP client can't honor. The UDP
+// listener of InfluxDB writes all points to the database and retention
+// policy it is configured with, and parses timestamps with its own
+// precision. The UDP client always sends nanosecond timestamps, without
+// consistency or compression.
+func (i *InfluxdbFirehoseNozzle) checkUDPConfig() error {
+	switch {
+	case len(i.config.InfluxDbEndpoints) > 0:
+		return errors.New("InfluxDbEndpoints can't be used with InfluxDbUDPAddress")
+	case len(i.config.RoutingRules) > 0:
+		return errors.New("RoutingRules can't be used with InfluxDbUDPAddress")
+	case i.config.RetentionPolicy != "":
+		return errors.New("RetentionPolicy can't be used with InfluxDbUDPAddress")
+	case i.config.Precision != "":
+		return errors.New("Precision can't be used with InfluxDbUDPAddress")
+	case i.config.WriteConsistency != "":
+		return errors.New("WriteConsistency can't be used with InfluxDbUDPAddress")
+	case i.config.GzipWrites:
+		return errors.New("GzipWrites can't be used with InfluxDbUDPAddress")
+	}
+	for n, o := range i.config.WriteOverrides {
+		if o.RetentionPolicy != "" {
+			return fmt.Errorf("Invalid write override %d: RetentionPolicy can't be used with InfluxDbUDPAddress", n)
+		}
+		if o.Precision != "" {
+			return fmt.Errorf("Invalid write override %d: Precision can't be used with InfluxDbUDPAddress", n)
+		}
+	}
+	return nil
+}
+
+// checkV2Config rejects retention policies with InfluxDB 2.x. The
+// /api/v2/write endpoint takes a bucket name, retention policies only map
+// to buckets on the 1.x compatibility endpoint.
+func (i *InfluxdbFirehoseNozzle) checkV2Config() error {
+	if i.config.RetentionPolicy != "" {
+		return errors.New("RetentionPolicy can't be used with InfluxDbVersion 2")
+	}
+	for n, o := range i.config.WriteOverrides {
+		if o.RetentionPolicy != "" {
+			return fmt.Errorf("Invalid write override %d: RetentionPolicy can't be used with InfluxDbVersion 2", n)
+		}
+	}
+	for n, r := range i.config.RoutingRules {
+		if r.RetentionPolicy != "" {
+			return fmt.Errorf("Invalid routing rule %d: RetentionPolicy can't be used with InfluxDbVersion 2", n)
+		}
+	}
+	return nil
+}
+
+// newClient creates the HTTP client of the configured InfluxDB version.
+func (i *InfluxdbFirehoseNozzle) newClient(addr, user, password, token string) (influxdbclient.Client, error) {
+	var encoder *gzipEncoder
+	if i.config.GzipWrites {
+		var err error
+		encoder, err = newGzipEncoder(addr, i.config.GzipLevel, i.Log)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch i.config.InfluxDbVersion {
+	case "", influxDbVersion1:
+		c, err := influxdbclient.NewHTTPClient(influxdbclient.HTTPConfig{
+			Addr:               addr,
+			Username:           user,
+			Password:           password,
+			UserAgent:          i.config.FirehoseSubscriptionID,
+			InsecureSkipVerify: !i.config.InfluxDbAllowSelfSigned,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return newV1Client(c, addr, user, password, i.config.FirehoseSubscriptionID, !i.config.InfluxDbAllowSelfSigned, encoder)
+	case influxDbVersion2:
+		c, err := newV2Client(addr, i.config.InfluxDbOrg, token, i.config.FirehoseSubscriptionID, i.config.InfluxDbAllowSelfSigned)
+		if err != nil {
+			return nil, err
+		}
+		c.gzip = encoder
+		return c, nil
+	default:
+		return nil, fmt.Errorf("Unsupported InfluxDB version %s", i.config.InfluxDbVersion)
+	}
+}
+
+func (i *InfluxdbFirehoseNozzle) createMultiClient() (influxdbclient.Client, error) {
+	mode := i.config.EndpointMode
+	switch mode {
+	case "":
+		mode = nozzleconfig.EndpointModeFailover
+	case nozzleconfig.EndpointModeFailover, nozzleconfig.EndpointModeMirror:
+	default:
+		return nil, fmt.Errorf("Unsupported endpoint mode %s", mode)
+	}
+
+	backoff, maxBackoff := i.retryBackoff()
+	i.endpoints = nil
+	for _, e := range i.config.InfluxDbEndpoints {
+		c, err := i.newClient(e.URL, e.User, e.Password, e.Token)
+		if err != nil {
+			return nil, err
+		}
+		i.endpoints = append(i.endpoints, &endpoint{
+			url:             e.URL,
+			client:          c,
+			log:             i.Log,
+			slots:           make(chan struct{}, i.writerCount()),
+			backoff:         backoff,
+			maxBackoff:      maxBackoff,
+			maxMissedPoints: i.maxBufferedPoints(),
+		})
+	}
+	i.Log.Infof("Writing to %d InfluxDB endpoints in %s mode", len(i.endpoints), mode)
+	return &multiClient{mode: mode, endpoints: i.endpoints}, nil
+}
+
+// database returns the database points are written to, which is the
+// bucket for InfluxDB 2.x.
+func (i *InfluxdbFirehoseNozzle) database() string {
+	if i.config.InfluxDbVersion == influxDbVersion2 && i.config.InfluxDbBucket != "" {
+		return i.config.InfluxDbBucket
+	}
+	return i.config.InfluxDbDatabase
+}
+
 // Start is openning the connection to the firehose and forwarding messages to influxDB.
+// It returns once Stop is called or the firehose fails with an error the
+// consumer doesn't reconnect after.
 func (i *InfluxdbFirehoseNozzle) Start() error {
 	var authToken string
 
+	i.stopLock.Lock()
+	i.stop = make(chan struct{})
+	stop := i.stop
+	i.stopLock.Unlock()
+
 	if !i.config.DisableAccessControl {
 		authToken = i.authTokenFetcher.FetchAuthToken()
 	}
 
 	i.Log.Info("Starting Influxdb Firehose Nozzle...")
-	err := i.createClient()
+	if addr := i.healthAddress(); addr != "" {
+		server, err := i.startHealthServer(addr)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+	}
+
+	filter, err := newEnvelopeFilter(i.config.Filters)
+	if err != nil {
+		return err
+	}
+	i.filter = filter
+
+	relabeler, err := newRelabeler(i.config.RelabelRules)
+	if err != nil {
+		return err
+	}
+	i.relabeler = relabeler
+	i.cardinality, err = newCardinalityGuard(i.config, i.Log)
 	if err != nil {
 		return err
 	}
+
+	err = checkPrecision(i.config.Precision)
+	if err != nil {
+		return err
+	}
+	i.writeOverrides, err = newWriteOverrides(i.config.WriteOverrides)
+	if err != nil {
+		return err
+	}
+	i.routingRules, err = newRoutingRules(i.config.RoutingRules)
+	if err != nil {
+		return err
+	}
+
+	if i.config.SpoolDirectory != "" {
+		i.spool, err = newSpool(i.config.SpoolDirectory, i.config.SpoolMaxMegabytes, i.Log)
+		if err != nil {
+			return err
+		}
+		i.Log.Infof("Spooling failed writes to %s, %d segments pending", i.config.SpoolDirectory, i.spool.len())
+	}
+	if i.config.DeadLetterFile != "" {
+		i.deadLetter = newDeadLetterFile(i.config.DeadLetterFile, i.config.DeadLetterMaxMegabytes)
+	}
+
+	err = i.createClient()
+	if err != nil {
+		return err
+	}
+	if i.config.CreateDatabase {
+		err = i.createDatabases()
+		if err != nil {
+			return err
+		}
+	}
+	i.startWriters()
 	i.consumeFirehose(authToken)
-	err = i.postToInfluxDB()
+	err = i.postToInfluxDB(stop)
 	i.Log.Info("Influxdb Firehose Nozzle shutting down...")
 	return err
 }
 
+// Stop makes a running Start write the pending points and return.
+func (i *InfluxdbFirehoseNozzle) Stop() {
+	i.stopLock.Lock()
+	defer i.stopLock.Unlock()
+	if i.stop != nil {
+		close(i.stop)
+		i.stop = nil
+	}
+}
+
 func (i *InfluxdbFirehoseNozzle) consumeFirehose(authToken string) {
 	i.Consumer.SetIdleTimeout(time.Duration(i.config.IdleTimeoutSeconds) * time.Second)
+	i.Consumer.SetOnConnectCallback(func() {
+		atomic.StoreInt32(&i.firehoseConnected, 1)
+	})
 	i.Messages, i.Errs = i.Consumer.Firehose(i.config.FirehoseSubscriptionID, authToken)
 }
 
-func (i *InfluxdbFirehoseNozzle) postToInfluxDB() (err error) {
+// postToInfluxDB forwards the envelopes until it is stopped. The consumer
+// reconnects by itself after errors wrapped in a RetryError, the nozzle
+// only gives up on other errors.
+func (i *InfluxdbFirehoseNozzle) postToInfluxDB(stop <-chan struct{}) (err error) {
 	ticker := time.NewTicker(time.Duration(i.config.FlushDurationSeconds) * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			// TODO: Refactor, post metrics should run in it's own process
-			err = i.postMetrics()
-			if err != nil {
-				return err
-			}
+			i.postMetrics()
 		case envelope := <-i.Messages:
 			i.handleMessage(envelope)
 			i.AddMetric(envelope)
-			if err != nil {
-				return err
-			}
 		case err := <-i.Errs:
 			i.handleError(err)
+			if _, ok := err.(noaaerrors.RetryError); ok {
+				continue
+			}
+			i.Log.Infof("Closing connection with traffic controller due to %v", err)
+			i.shutdown()
 			return err
+		case <-stop:
+			i.Log.Info("Closing connection with traffic controller")
+			i.shutdown()
+			return nil
 		}
 	}
 }
 
-func (i *InfluxdbFirehoseNozzle) postMetrics() (err error) {
-	err = i.Client.Write(i.batchPoints)
-	if err != nil {
-		i.Log.Errorf("FATAL ERROR: %s\n\n", err)
-		return
+// shutdown closes the connection to the firehose and writes the pending
+// points.
+func (i *InfluxdbFirehoseNozzle) shutdown() {
+	atomic.StoreInt32(&i.firehoseConnected, 0)
+	i.Consumer.Close()
+	go discardFirehose(i.Messages, i.Errs)
+	i.postMetrics()
+	i.stopWriters()
+}
+
+// discardFirehose drains the channels of a closed consumer until it closes
+// them, so it doesn't block delivering what it read before it was closed.
+func discardFirehose(messages <-chan *events.Envelope, errs <-chan error) {
+	for messages != nil || errs != nil {
+		select {
+		case _, ok := <-messages:
+			if !ok {
+				messages = nil
+			}
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+		}
 	}
-	i.newBatchPoints()
-	return
 }
 
-func (i *InfluxdbFirehoseNozzle) newBatchPoints() {
-	bp, _ := influxdbclient.NewBatchPoints(influxdbclient.BatchPointsConfig{
-		Database: i.config.InfluxDbDatabase,
-	})
-	i.batchPoints = bp
+func (i *InfluxdbFirehoseNozzle) postMetrics() {
+	atomic.AddUint64(&i.stats.flushes, 1)
+	if i.config.HttpMetrics == nozzleconfig.HttpMetricsAggregate {
+		i.addHTTPAggregates()
+	}
+	i.addNozzleMetrics()
+	i.addFilterMetrics()
+	i.addCardinalityMetrics()
+	i.addWriterMetrics()
+	i.addRejectionMetrics()
+	i.addEndpointMetrics()
+	i.expireCounters()
+	if i.logMessagesDropped > 0 {
+		i.Log.Warnf("Dropped %d log messages exceeding the limit of %d per flush", i.logMessagesDropped, i.config.LogMessagesMaxPerFlush)
+		i.logMessagesDropped = 0
+	}
+	i.logMessagesInFlush = 0
+	i.queueBatches()
 }
 
 func (i *InfluxdbFirehoseNozzle) handleMessage(envelope *events.Envelope) {
@@ -139,36 +439,131 @@ func (i *InfluxdbFirehoseNozzle) handleMessage(envelope *events.Envelope) {
 
 // AddMetric is parsing envelop events and adding numeric metrics to the influx batch cache
 func (i *InfluxdbFirehoseNozzle) AddMetric(envelope *events.Envelope) error {
-	i.totalMessagesReceived++
-	if envelope.GetEventType() == events.Envelope_ValueMetric || envelope.GetEventType() == events.Envelope_CounterEvent {
-
-		tags := map[string]string{
-			"deployment": envelope.GetDeployment(),
-			"job":        envelope.GetJob(),
-			"index":      envelope.GetIndex(),
-			"ip":         envelope.GetIp(),
+	atomic.AddUint64(&i.stats.messagesReceived, 1)
+	if i.filter != nil {
+		if ok, rule := i.filter.check(envelope); !ok {
+			i.filteredEnvelopes[rule]++
+			return nil
 		}
+	}
 
-		for k, v := range envelope.GetTags() {
-			tags[k] = v
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric, events.Envelope_CounterEvent, events.Envelope_ContainerMetric, events.Envelope_Error:
+	case events.Envelope_HttpStartStop:
+		switch i.config.HttpMetrics {
+		case nozzleconfig.HttpMetricsPoints:
+		case nozzleconfig.HttpMetricsAggregate:
+			return i.aggregateHTTPStartStop(envelope)
+		default:
+			return nil
 		}
-
-		v, err := GetValue(envelope)
-		fields := map[string]interface{}{
-			"value": v,
+	case events.Envelope_LogMessage:
+		if i.config.EnableLogMessages {
+			return i.addLogMessage(envelope)
 		}
+		return nil
+	default:
+		return nil
+	}
 
-		t := time.Unix(0, envelope.GetTimestamp())
-		n, err := GetName(envelope)
-		pt, err := influxdbclient.NewPoint(n, tags, fields, t)
-		if err != nil {
-			return errors.New("Failed to add Point")
+	fields, err := GetFields(envelope)
+	if err != nil {
+		return err
+	}
+	if envelope.GetEventType() == events.Envelope_Error && i.config.IncludeErrorMessages {
+		fields["message"] = envelope.GetError().GetMessage()
+	}
+
+	tags := getTags(envelope)
+	i.addTemplateTags(envelope, tags)
+	i.applyRelabeling(envelope, tags)
+
+	t := time.Unix(0, envelope.GetTimestamp())
+	n, err := i.measurementName(envelope)
+	if err != nil {
+		return err
+	}
+	n, ok := i.admitSeries(n, tags)
+	if !ok {
+		return nil
+	}
+	// Rates are computed after the cardinality limits, so only admitted
+	// series keep counter state.
+	if envelope.GetEventType() == events.Envelope_CounterEvent && i.config.CounterRates {
+		if rate, ok := i.counterRate(n, tags, envelope.GetCounterEvent().GetTotal(), t); ok {
+			fields["rate"] = rate
 		}
-		i.batchPoints.AddPoint(pt)
+	}
+	err = i.addSeriesPoint(i.route(envelope, tags), n, tags, fields, t)
+	if err != nil {
+		return errors.New("Failed to add Point")
 	}
 	return nil
 }
 
+// addPoint adds a point derived from the firehose to the batch of its
+// route, unless it exceeds the cardinality limits.
+func (i *InfluxdbFirehoseNozzle) addPoint(r route, name string, tags map[string]string, fields map[string]interface{}, t time.Time) error {
+	name, ok := i.admitSeries(name, tags)
+	if !ok {
+		return nil
+	}
+	return i.addSeriesPoint(r, name, tags, fields, t)
+}
+
+// admitSeries prepends the metric prefix to the measurement name and
+// applies the cardinality limits. It returns false if the point has to be
+// dropped, tag values exceeding the limits are collapsed in place.
+func (i *InfluxdbFirehoseNozzle) admitSeries(name string, tags map[string]string) (string, bool) {
+	name = i.prefixName(name)
+	if i.cardinality != nil && !i.cardinality.check(name, tags) {
+		i.countDroppedPoints(1)
+		return name, false
+	}
+	return name, true
+}
+
+// addSeriesPoint adds a point of an admitted series to the batch of its
+// route.
+func (i *InfluxdbFirehoseNozzle) addSeriesPoint(r route, name string, tags map[string]string, fields map[string]interface{}, t time.Time) error {
+	pt, err := influxdbclient.NewPoint(name, tags, fields, t)
+	if err != nil {
+		return err
+	}
+	i.addToBatch(r, pt)
+	return nil
+}
+
+func getTags(envelope *events.Envelope) map[string]string {
+	tags := map[string]string{
+		"deployment": envelope.GetDeployment(),
+		"job":        envelope.GetJob(),
+		"index":      envelope.GetIndex(),
+		"ip":         envelope.GetIp(),
+	}
+
+	for k, v := range envelope.GetTags() {
+		tags[k] = v
+	}
+
+	switch envelope.GetEventType() {
+	case events.Envelope_ContainerMetric:
+		tags["application_id"] = envelope.GetContainerMetric().GetApplicationId()
+		tags["instance_index"] = strconv.Itoa(int(envelope.GetContainerMetric().GetInstanceIndex()))
+	case events.Envelope_HttpStartStop:
+		httpStartStop := envelope.GetHttpStartStop()
+		tags["application_id"] = formatUUID(httpStartStop.GetApplicationId())
+		tags["method"] = httpStartStop.GetMethod().String()
+		tags["peer_type"] = httpStartStop.GetPeerType().String()
+		tags["status_class"] = statusClass(httpStartStop.GetStatusCode())
+	case events.Envelope_Error:
+		tags["origin"] = envelope.GetOrigin()
+		tags["source"] = envelope.GetError().GetSource()
+		tags["code"] = strconv.Itoa(int(envelope.GetError().GetCode()))
+	}
+	return tags
+}
+
 // GetName generates event name string
 func GetName(envelope *events.Envelope) (string, error) {
 	switch envelope.GetEventType() {
@@ -176,6 +571,12 @@ func GetName(envelope *events.Envelope) (string, error) {
 		return envelope.GetOrigin() + "." + envelope.GetValueMetric().GetName(), nil
 	case events.Envelope_CounterEvent:
 		return envelope.GetOrigin() + "." + envelope.GetCounterEvent().GetName(), nil
+	case events.Envelope_ContainerMetric:
+		return envelope.GetOrigin() + "." + events.Envelope_ContainerMetric.String(), nil
+	case events.Envelope_HttpStartStop:
+		return envelope.GetOrigin() + "." + events.Envelope_HttpStartStop.String(), nil
+	case events.Envelope_Error:
+		return errorsMeasurement, nil
 	default:
 		return "", errors.New("Unknown event type")
 	}
@@ -193,34 +594,100 @@ func GetValue(envelope *events.Envelope) (float64, error) {
 	}
 }
 
-func (i *InfluxdbFirehoseNozzle) alertSlowConsumerError() {
-	i.addInternalMetric("slowConsumerAlert", uint64(1))
+// GetFields extracts all fields of a point from different event types.
+// Single value events are stored in the "value" field. Counter events
+// additionally have "total" and "delta" fields.
+func GetFields(envelope *events.Envelope) (map[string]interface{}, error) {
+	switch envelope.GetEventType() {
+	case events.Envelope_ContainerMetric:
+		m := envelope.GetContainerMetric()
+		return map[string]interface{}{
+			"cpu_percentage":     m.GetCpuPercentage(),
+			"memory_bytes":       float64(m.GetMemoryBytes()),
+			"disk_bytes":         float64(m.GetDiskBytes()),
+			"memory_bytes_quota": float64(m.GetMemoryBytesQuota()),
+			"disk_bytes_quota":   float64(m.GetDiskBytesQuota()),
+		}, nil
+	case events.Envelope_HttpStartStop:
+		httpStartStop := envelope.GetHttpStartStop()
+		return map[string]interface{}{
+			"duration_ms": durationMillis(httpStartStop),
+			"status_code": float64(httpStartStop.GetStatusCode()),
+		}, nil
+	case events.Envelope_Error:
+		return map[string]interface{}{
+			"count": float64(1),
+		}, nil
+	case events.Envelope_CounterEvent:
+		m := envelope.GetCounterEvent()
+		return map[string]interface{}{
+			"value": float64(m.GetTotal()),
+			"total": float64(m.GetTotal()),
+			"delta": float64(m.GetDelta()),
+		}, nil
+	default:
+		v, err := GetValue(envelope)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"value": v,
+		}, nil
+	}
 }
 
 func (i *InfluxdbFirehoseNozzle) addInternalMetric(name string, value uint64) {
+	i.addInternalMetricWithTags(name, value, nil)
+}
+
+func (i *InfluxdbFirehoseNozzle) addInternalMetricWithTags(name string, value uint64, extraTags map[string]string) {
 	tags := map[string]string{
 		"deployment": i.config.Deployment,
 	}
+	for k, v := range extraTags {
+		tags[k] = v
+	}
 
 	fields := map[string]interface{}{
 		"value": float64(value),
 	}
 
 	t := time.Now()
-	pt, _ := influxdbclient.NewPoint(name, tags, fields, t)
-	i.batchPoints.AddPoint(pt)
+	pt, _ := influxdbclient.NewPoint(i.internalMetricName(name), tags, fields, t)
+	i.addToBatch(route{}, pt)
+}
+
+// prefixName prepends the configured metric prefix to a measurement name.
+func (i *InfluxdbFirehoseNozzle) prefixName(name string) string {
+	return i.joinPrefix(i.config.MetricPrefix, name)
+}
+
+// joinPrefix joins a prefix and a name with MetricPrefixSeparator.
+func (i *InfluxdbFirehoseNozzle) joinPrefix(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	separator := i.config.MetricPrefixSeparator
+	if separator == "" {
+		separator = defaultMetricPrefixSeparator
+	}
+	return strings.TrimSuffix(prefix, separator) + separator + name
 }
 
 func (i *InfluxdbFirehoseNozzle) handleError(err error) {
 	switch err.(type) {
 	case noaaerrors.RetryError:
+		atomic.AddUint64(&i.stats.reconnects, 1)
 		i.Log.Errorf("Reconnecting: %v", err)
+		if isPolicyViolation(err) {
+			i.Log.Infof("The traffic controller closed the connection because the nozzle is not keeping up. Please try scaling up the nozzle.")
+			i.alertSlowConsumerError()
+		}
 	default:
 		i.Log.Errorf("Error while reading from the firehose: %v", err)
 
 	}
 
-	i.Log.Infof("Closing connection with traffic controller due to %v", err)
-	i.Consumer.Close()
-	i.postMetrics()
+	atomic.StoreInt32(&i.firehoseConnected, 0)
+	i.recordError(err)
 }
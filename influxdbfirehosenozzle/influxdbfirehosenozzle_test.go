@@ -2,9 +2,15 @@ package influxdbfirehosenozzle_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
-	"regexp"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	. "github.com/cloudfoundry-incubator/datadog-firehose-nozzle/testhelpers"
 	"github.com/cloudfoundry-incubator/datadog-firehose-nozzle/uaatokenfetcher"
@@ -34,6 +40,27 @@ var _ = Describe("Influxdbfirehosenozzle", func() {
 		fakeInfluxDB *FakeInfluxDB
 	)
 
+	// startNozzle starts the nozzle and stops it once the fake firehose
+	// closed the connection after sending its events, before the consumer
+	// reconnects.
+	startNozzle := func() error {
+		n, buffer := nozzle, fakeBuffer
+		reconnects := strings.Count(buffer.GetContent(), "Reconnecting")
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			for strings.Count(buffer.GetContent(), "Reconnecting") == reconnects {
+				select {
+				case <-finished:
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			n.Stop()
+		}()
+		return n.Start()
+	}
+
 	It("Should return error if type is unknown.", func() {
 		envelope := events.Envelope{
 			Origin:    proto.String("doppler"),
@@ -52,6 +79,37 @@ var _ = Describe("Influxdbfirehosenozzle", func() {
 		Expect(err).ToNot(BeNil())
 	})
 
+	It("Should return all container metric fields.", func() {
+		envelope := events.Envelope{
+			Origin:    proto.String("rep"),
+			Timestamp: proto.Int64(1000000000),
+			EventType: events.Envelope_ContainerMetric.Enum(),
+			ContainerMetric: &events.ContainerMetric{
+				ApplicationId:    proto.String("app-id"),
+				InstanceIndex:    proto.Int32(2),
+				CpuPercentage:    proto.Float64(12.5),
+				MemoryBytes:      proto.Uint64(1024),
+				DiskBytes:        proto.Uint64(2048),
+				MemoryBytesQuota: proto.Uint64(8192),
+				DiskBytesQuota:   proto.Uint64(4096),
+			},
+		}
+
+		n, err := GetName(&envelope)
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal("rep.ContainerMetric"))
+
+		fields, err := GetFields(&envelope)
+		Expect(err).To(BeNil())
+		Expect(fields).To(Equal(map[string]interface{}{
+			"cpu_percentage":     12.5,
+			"memory_bytes":       float64(1024),
+			"disk_bytes":         float64(2048),
+			"memory_bytes_quota": float64(8192),
+			"disk_bytes_quota":   float64(4096),
+		}))
+	})
+
 	Describe("Integration test", func() {
 
 		BeforeEach(func() {
@@ -87,13 +145,14 @@ var _ = Describe("Influxdbfirehosenozzle", func() {
 		})
 
 		AfterEach(func() {
+			nozzle.Stop()
 			fakeUAA.Close()
 			fakeFirehose.Close()
 			fakeInfluxDB.Close()
 		})
 
 		It("gets a valid authentication token", func() {
-			go nozzle.Start()
+			go startNozzle()
 			Eventually(fakeFirehose.Requested).Should(BeTrue())
 			Consistently(fakeFirehose.LastAuthorization).Should(Equal("bearer 123456789"))
 		})
@@ -123,30 +182,31 @@ var _ = Describe("Influxdbfirehosenozzle", func() {
 				fakeFirehose.AddEvent(envelope)
 			}
 
-			go nozzle.Start()
+			go startNozzle()
 
 			var contents []byte
 			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
 
 			Expect(fakeBuffer.GetContent()).ToNot(ContainSubstring("Error while reading from the firehose"))
-			// +3 internal metrics that show totalMessagesReceived, totalMetricSent, and slowConsumerAlert
-			Expect(string(contents)).Should(Equal(
-				`origin.metricName-0,deployment=deployment-name,job=doppler value=0 1000000000
-origin.metricName-1,deployment=deployment-name,job=doppler value=1 1000000000
-origin.metricName-2,deployment=deployment-name,job=doppler value=2 1000000000
-origin.metricName-3,deployment=deployment-name,job=doppler value=3 1000000000
-origin.metricName-4,deployment=deployment-name,job=doppler value=4 1000000000
-origin.metricName-5,deployment=deployment-name,job=doppler value=5 1000000000
-origin.metricName-6,deployment=deployment-name,job=doppler value=6 1000000000
-origin.metricName-7,deployment=deployment-name,job=doppler value=7 1000000000
-origin.metricName-8,deployment=deployment-name,job=doppler value=8 1000000000
-origin.metricName-9,deployment=deployment-name,job=doppler value=9 1000000000
+			// internal metrics like totalMessagesReceived and slowConsumerAlert are written on every flush
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.origin.metricName-0,deployment=deployment-name,job=doppler value=0 1000000000
+datadog.nozzle.origin.metricName-1,deployment=deployment-name,job=doppler value=1 1000000000
+datadog.nozzle.origin.metricName-2,deployment=deployment-name,job=doppler value=2 1000000000
+datadog.nozzle.origin.metricName-3,deployment=deployment-name,job=doppler value=3 1000000000
+datadog.nozzle.origin.metricName-4,deployment=deployment-name,job=doppler value=4 1000000000
+datadog.nozzle.origin.metricName-5,deployment=deployment-name,job=doppler value=5 1000000000
+datadog.nozzle.origin.metricName-6,deployment=deployment-name,job=doppler value=6 1000000000
+datadog.nozzle.origin.metricName-7,deployment=deployment-name,job=doppler value=7 1000000000
+datadog.nozzle.origin.metricName-8,deployment=deployment-name,job=doppler value=8 1000000000
+datadog.nozzle.origin.metricName-9,deployment=deployment-name,job=doppler value=9 1000000000
 `))
 		}, 2)
 
 		It("InfluxDB is down", func(done Done) {
 			defer close(done)
 
+			config.RetryInitialBackoffMillis = 50
 			for i := 0; i < 10; i++ {
 				envelope := events.Envelope{
 					Origin:    proto.String("origin"),
@@ -164,123 +224,1525 @@ origin.metricName-9,deployment=deployment-name,job=doppler value=9 1000000000
 			}
 
 			fakeInfluxDB.Close()
-			Expect(nozzle.Start()).To(HaveOccurred())
+			go startNozzle()
+
+			Eventually(fakeBuffer.GetContent).Should(ContainSubstring("retrying"))
+			fakeInfluxDB.Restart()
+
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+			Expect(string(contents)).Should(HavePrefix(
+				`datadog.nozzle.origin.metricName-0,deployment=deployment-name,job=doppler value=0 1000000000
+`))
 		}, 2)
 
-		It("Catch slow consumer alerts", func(done Done) {
+		It("Retry server errors", func(done Done) {
 			defer close(done)
 
-			envelope := events.Envelope{
-				Origin:    proto.String("doppler"),
-				Timestamp: proto.Int64(1000000000),
-				EventType: events.Envelope_CounterEvent.Enum(),
-				CounterEvent: &events.CounterEvent{
-					Name:  proto.String("TruncatingBuffer.DroppedMessages"),
-					Delta: proto.Uint64(1),
-					Total: proto.Uint64(10),
-				},
-				Deployment: proto.String("deployment-name"),
-				Job:        proto.String("doppler"),
-			}
+			config.RetryInitialBackoffMillis = 10
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeInfluxDB.FailNextWrites(2, http.StatusServiceUnavailable, `{"error":"timeout"}`)
+
+			go startNozzle()
+
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000
+`))
+			Expect(fakeInfluxDB.FailedWrites()).To(Equal(2))
+		}, 2)
+
+		It("Keep batches rejected because of the InfluxDB setup", func(done Done) {
+			defer close(done)
+
+			config.RetryInitialBackoffMillis = 10
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeInfluxDB.FailNextWrites(1, http.StatusNotFound, `{"error":"database not found: \"cf\""}`)
+
+			startNozzle()
+
+			Expect(fakeBuffer.GetContent()).To(MatchRegexp(`InfluxDB rejected the write, check the database.*database not found`))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("keeping"))
+			Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("retrying"))
+			Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("Dropping"))
+			Expect(fakeInfluxDB.FailedWrites()).To(Equal(1))
+			Expect(fakeInfluxDB.ReceivedContents).NotTo(Receive())
+
+			// The kept points are written once the database exists.
+			startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+			Expect(withoutInternalMetrics(contents)).To(HavePrefix(
+				`datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000
+`))
+		}, 5)
+
+		It("Split batches rejected as too large", func(done Done) {
+			defer close(done)
+
+			config.RetryInitialBackoffMillis = 10
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeInfluxDB.FailNextWrites(1, http.StatusRequestEntityTooLarge, `{"error":"Request Entity Too Large"}`)
+
+			startNozzle()
+
+			Expect(fakeInfluxDB.FailedWrites()).To(Equal(1))
+			var first, second []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&first))
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&second))
+			Expect(countLines(first) + countLines(second)).To(Equal(countLines(fakeInfluxDB.FailedContents()[0])))
+			Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("retrying"))
+			Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("Dropping"))
+		}, 2)
+
+		It("Quarantine single points rejected as too large", func(done Done) {
+			defer close(done)
+
+			config.RetryInitialBackoffMillis = 10
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeInfluxDB.FailNextWrites(1000, http.StatusRequestEntityTooLarge, `{"error":"Request Entity Too Large"}`)
+
+			startNozzle()
+
+			rejected := fakeInfluxDB.FailedContents()[0]
+			Expect(strings.Count(fakeBuffer.GetContent(), "Dropping 1 points rejected by InfluxDB (entity_too_large)")).To(Equal(countLines(rejected)))
+			Expect(fakeInfluxDB.ReceivedContents).NotTo(Receive())
+		}, 2)
+
+		It("Quarantine points with conflicting field types and resend the rest", func(done Done) {
+			defer close(done)
+
+			dir, err := ioutil.TempDir("", "deadletter")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			config.DeadLetterFile = filepath.Join(dir, "rejected.lp")
+			fakeInfluxDB.ConflictField("datadog.nozzle.origin.metricName", "value")
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			envelope := taggedValueMetricEnvelope(1)
+			envelope.ValueMetric.Name = proto.String("otherMetric")
 			fakeFirehose.AddEvent(envelope)
 
-			go nozzle.Start()
+			startNozzle()
+
 			var contents []byte
 			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+			Expect(withoutInternalMetrics(contents)).To(Equal(
+				`datadog.nozzle.origin.otherMetric,deployment=deployment-name,job=doppler,request_id=r-1 value=1 1000000000
+`))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("Quarantined 1 points rejected by InfluxDB (field_type_conflict)"))
+			deadLetters, err := ioutil.ReadFile(config.DeadLetterFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(deadLetters)).To(MatchRegexp(`^# .*reason=field_type_conflict.*\n` +
+				`datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000\n$`))
+
+			// Rejected points are counted with the next flush.
+			startNozzle()
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+			Expect(string(contents)).To(ContainSubstring("datadog.nozzle.rejectedPoints,reason=field_type_conflict value=1 "))
+		}, 5)
+
+		It("Log points rejected by InfluxDB without dead-letter file", func(done Done) {
+			defer close(done)
+
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeInfluxDB.FailNextWrites(1, http.StatusBadRequest, `{"error":"partial write: max-values-per-tag limit exceeded (100001/100000): measurement=\"datadog.nozzle.origin.metricName\" tag=\"request_id\" value=\"r-0\" dropped=1"}`)
+
+			go startNozzle()
 
-			matched, _ := regexp.MatchString("slowConsumerAlert value=1 .*\ndoppler.TruncatingBuffer.DroppedMessages,deployment=deployment-name,job=doppler value=10 1000000000", string(contents))
-			Expect(matched).Should(BeTrue())
+			Eventually(fakeBuffer.GetContent).Should(ContainSubstring("Dropping 1 points rejected by InfluxDB (max_values_per_tag)"))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("Rejected point: datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000"))
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+			Expect(withoutInternalMetrics(contents)).To(BeEmpty())
 		}, 2)
 
-		It("Ignore none numeric events", func(done Done) {
+		It("Quarantine rejected points of spooled batches", func(done Done) {
 			defer close(done)
-			envelope := events.Envelope{
-				Origin:    proto.String("doppler"),
-				Timestamp: proto.Int64(1000000000),
-				EventType: events.Envelope_LogMessage.Enum(),
-				LogMessage: &events.LogMessage{
-					Message:     []byte("FOO"),
-					MessageType: events.LogMessage_OUT.Enum(),
-				},
-				Deployment: proto.String("deployment-name"),
-				Job:        proto.String("doppler"),
+
+			dir, err := ioutil.TempDir("", "spool")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			config.SpoolDirectory = dir
+			config.RetryMaxAttempts = 1
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeInfluxDB.FailNextWrites(1, http.StatusServiceUnavailable, `{"error":"timeout"}`)
+
+			startNozzle()
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("spooled"))
+
+			fakeInfluxDB.ConflictField("datadog.nozzle.origin.metricName", "value")
+			nozzle = NewInfluxDBFirehoseNozzle(config, tokenFetcher, log)
+			startNozzle()
+
+			// The point is rejected once when replayed and once with the new
+			// batch, the rest of the spooled batch is written first.
+			Expect(strings.Count(fakeBuffer.GetContent(), "Dropping 1 points rejected by InfluxDB (field_type_conflict)")).To(Equal(2))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("Replayed"))
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+			Expect(string(contents)).NotTo(ContainSubstring("datadog.nozzle.origin.metricName"))
+			segments, _ := filepath.Glob(filepath.Join(dir, "*.lp"))
+			Expect(segments).To(BeEmpty())
+		}, 5)
+
+		It("Count points dropped from partial writes", func(done Done) {
+			defer close(done)
+
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(1))
+			fakeInfluxDB.FailNextWrites(1, http.StatusBadRequest, `{"error":"partial write: points beyond retention policy dropped=1"}`)
+
+			startNozzle()
+
+			Expect(fakeBuffer.GetContent()).To(MatchRegexp(`InfluxDB dropped 1 of \d+ points \(beyond_retention_policy\)`))
+			Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("rejected by InfluxDB"))
+			Expect(fakeInfluxDB.FailedWrites()).To(Equal(1))
+			Consistently(fakeInfluxDB.ReceivedContents).ShouldNot(Receive())
+
+			// Dropped points are counted with the next flush.
+			startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+			Expect(string(contents)).To(ContainSubstring("datadog.nozzle.rejectedPoints,reason=beyond_retention_policy value=1 "))
+		}, 5)
+
+		It("Limit the points kept for all databases together", func(done Done) {
+			defer close(done)
+
+			config.RetryMaxAttempts = 1
+			config.MaxBufferedPoints = 2
+			config.RoutingRules = []nozzleconfig.RoutingRule{
+				{Field: "tag", Tag: "request_id", Value: "r-1", Database: "tenant-a"},
 			}
-			fakeFirehose.AddEvent(envelope)
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(1))
+			fakeInfluxDB.FailNextWrites(100, http.StatusServiceUnavailable, `{"error":"timeout"}`)
 
-			go nozzle.Start()
+			startNozzle()
+			Expect(fakeInfluxDB.ReceivedContents).NotTo(Receive())
+
+			// The points of both databases are older than the internal
+			// metrics of the next flush, so they are dropped first.
+			fakeInfluxDB.FailNextWrites(0, 0, "")
+			startNozzle()
+			Expect(fakeBuffer.GetContent()).To(MatchRegexp(`Buffer exceeds 2 points, dropping the \d+ oldest points`))
+			written := 0
+			for len(fakeInfluxDB.ReceivedContents) > 0 {
+				contents := <-fakeInfluxDB.ReceivedContents
+				Expect(string(contents)).NotTo(ContainSubstring("request_id="))
+				written += countLines(contents)
+			}
+			Expect(written).To(Equal(2))
+		}, 5)
+
+		It("Spool failed batches to disk and replay them after a restart", func(done Done) {
+			defer close(done)
+
+			dir, err := ioutil.TempDir("", "spool")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			config.SpoolDirectory = dir
+			config.RetryMaxAttempts = 1
+			config.Precision = "s"
+			config.WriteConsistency = "all"
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeInfluxDB.FailNextWrites(1, http.StatusServiceUnavailable, `{"error":"timeout"}`)
+
+			startNozzle()
+			segments, _ := filepath.Glob(filepath.Join(dir, "*.lp"))
+			Expect(segments).To(HaveLen(1))
+			segment, err := ioutil.ReadFile(segments[0])
+			Expect(err).NotTo(HaveOccurred())
+			spooled := bytes.SplitN(segment, []byte("\n"), 2)[1]
+			Expect(withoutInternalMetrics(spooled)).To(Equal(
+				`datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000
+`))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring(fmt.Sprintf("spooled %d points to disk", countLines(spooled))))
+
+			nozzle = NewInfluxDBFirehoseNozzle(config, tokenFetcher, log)
+			startNozzle()
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring(fmt.Sprintf("Replayed %d spooled points", countLines(spooled))))
+
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+			Expect(string(contents)).To(ContainSubstring("datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1\n"))
+			Expect(fakeInfluxDB.Queries()[1].Get("precision")).To(Equal("s"))
+			Expect(fakeInfluxDB.Queries()[1].Get("consistency")).To(Equal("all"))
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive())
+			segments, _ = filepath.Glob(filepath.Join(dir, "*.lp"))
+			Expect(segments).To(BeEmpty())
+		}, 5)
+
+		It("Report write queue metrics", func(done Done) {
+			defer close(done)
+
+			config.Deployment = "deployment-name"
+			config.WriterCount = 4
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+
+			go startNozzle()
 			var contents []byte
 			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
 
-			Expect(string(contents)).Should(Equal(``))
+			Expect(string(contents)).Should(MatchRegexp(`datadog.nozzle.writeQueueDepth,deployment=deployment-name value=0 \d+\n`))
+			Expect(string(contents)).Should(MatchRegexp(`datadog.nozzle.writesInFlight,deployment=deployment-name value=0 \d+\n`))
 		}, 2)
 
-		It("Add tags", func(done Done) {
+		It("Report internal metrics on every flush", func(done Done) {
 			defer close(done)
 
-			for i := 0; i < 3; i++ {
-				envelope := events.Envelope{
-					Origin:    proto.String("origin"),
-					Timestamp: proto.Int64(1000000000),
-					EventType: events.Envelope_ValueMetric.Enum(),
-					ValueMetric: &events.ValueMetric{
-						Name:  proto.String(fmt.Sprintf("metricName-%d", i)),
-						Value: proto.Float64(float64(i)),
-						Unit:  proto.String("gauge"),
-					},
-					Deployment: proto.String("deployment-name"),
-					Job:        proto.String("doppler"),
-					Tags: map[string]string{
-						fmt.Sprintf("tag-%d", i): "tagsvalue",
-						fmt.Sprintf("tag-%d", i): "tagsvalue",
-					},
-				}
-				fakeFirehose.AddEvent(envelope)
+			config.Deployment = "deployment-name"
+			config.InternalMetricsPrefix = "nozzle"
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(1))
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(string(contents)).Should(MatchRegexp(`\nnozzle.totalMessagesReceived,deployment=deployment-name value=2 \d+\n`))
+			Expect(string(contents)).Should(MatchRegexp(`\nnozzle.totalPointsWritten,deployment=deployment-name value=0 \d+\n`))
+			Expect(string(contents)).Should(MatchRegexp(`\nnozzle.totalPointsDropped,deployment=deployment-name value=0 \d+\n`))
+			Expect(string(contents)).Should(MatchRegexp(`\nnozzle.totalWriteErrors,deployment=deployment-name value=0 \d+\n`))
+			Expect(string(contents)).Should(MatchRegexp(`\nnozzle.totalReconnects,deployment=deployment-name value=\d+ \d+\n`))
+			Expect(string(contents)).Should(MatchRegexp(`\nnozzle.batchSize,deployment=deployment-name value=2 \d+\n`))
+			Expect(string(contents)).Should(MatchRegexp(`\nnozzle.flushLatencyMs,deployment=deployment-name value=0 \d+\n`))
+			Expect(string(contents)).Should(MatchRegexp(`\nnozzle.slowConsumerAlert,deployment=deployment-name value=0 \d+\n`))
+			Expect(string(contents)).Should(MatchRegexp(`\nnozzle.writeQueueDepth,deployment=deployment-name value=0 \d+\n`))
+			Expect(string(contents)).Should(HavePrefix("datadog.nozzle.origin.metricName,"))
+		}, 2)
+
+		It("Flush batches exceeding the maximum number of points early", func(done Done) {
+			defer close(done)
+
+			config.MaxBatchPoints = 4
+			for i := 0; i < 10; i++ {
+				fakeFirehose.AddEvent(taggedValueMetricEnvelope(i))
 			}
 
-			go nozzle.Start()
+			go startNozzle()
+
+			metrics := 0
+			for metrics < 10 {
+				var contents []byte
+				Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+				Expect(strings.Count(string(contents), "\n")).To(BeNumerically("<=", 4))
+				metrics += strings.Count(string(contents), "origin.metricName")
+			}
+			Expect(metrics).To(Equal(10))
+		}, 2)
+
+		It("Count batches flushed early in the batch size", func(done Done) {
+			defer close(done)
+
+			config.InternalMetricsPrefix = "nozzle"
+			config.MaxBatchPoints = 4
+			for i := 0; i < 10; i++ {
+				fakeFirehose.AddEvent(taggedValueMetricEnvelope(i))
+			}
 
+			go startNozzle()
+
+			var contents []byte
+			for !strings.Contains(string(contents), "nozzle.batchSize ") {
+				Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+			}
+			Expect(string(contents)).Should(MatchRegexp(`\nnozzle.batchSize value=10 \d+\n`))
+		}, 2)
+
+		It("Split batches exceeding the maximum size", func(done Done) {
+			defer close(done)
+
+			config.MaxBatchBytes = 200
+			for i := 0; i < 10; i++ {
+				fakeFirehose.AddEvent(taggedValueMetricEnvelope(i))
+			}
+
+			go startNozzle()
+
+			metrics := 0
+			for metrics < 10 {
+				var contents []byte
+				Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+				Expect(len(contents)).To(BeNumerically("<=", 200))
+				metrics += strings.Count(string(contents), "origin.metricName")
+			}
+			Expect(metrics).To(Equal(10))
+		}, 2)
+
+		It("Compress writes with gzip", func(done Done) {
+			defer close(done)
+
+			config.GzipWrites = true
+			config.GzipLevel = 9
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+
+			go startNozzle()
 			var contents []byte
 			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
 
-			Expect(fakeBuffer.GetContent()).ToNot(ContainSubstring("Error while reading from the firehose"))
-			// +3 internal metrics that show totalMessagesReceived, totalMetricSent, and slowConsumerAlert
-			Expect(string(contents)).Should(Equal(
-				`origin.metricName-0,deployment=deployment-name,job=doppler,tag-0=tagsvalue value=0 1000000000
-origin.metricName-1,deployment=deployment-name,job=doppler,tag-1=tagsvalue value=1 1000000000
-origin.metricName-2,deployment=deployment-name,job=doppler,tag-2=tagsvalue value=2 1000000000
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000
 `))
+			Expect(fakeInfluxDB.GzipWrites()).To(Equal(1))
+		}, 2)
+
+		It("Write uncompressed if InfluxDB doesn't accept gzip", func(done Done) {
+			defer close(done)
+
+			config.GzipWrites = true
+			config.GzipLevel = 1
+			fakeInfluxDB.RejectGzip()
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
 
+			Expect(withoutInternalMetrics(contents)).Should(HavePrefix("datadog.nozzle.origin.metricName,"))
+			Expect(fakeInfluxDB.GzipWrites()).To(Equal(0))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("doesn't accept gzip compressed writes"))
+			Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("Dropping"))
 		}, 2)
 
-		It("Handle RetryError", func(done Done) {
+		It("Fails to start with unsupported gzip level", func() {
+			config.GzipWrites = true
+			config.GzipLevel = 10
+			Expect(nozzle.Start()).To(MatchError("Unsupported gzip level 10, GzipLevel must range from 1 to 9"))
+		})
+
+		It("Compress writes with the default gzip level", func(done Done) {
+			defer close(done)
+
+			config.GzipWrites = true
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(HavePrefix("datadog.nozzle.origin.metricName,"))
+			Expect(fakeInfluxDB.GzipWrites()).To(Equal(1))
+		}, 2)
+
+		It("Write to InfluxDB 2.x", func(done Done) {
+			defer close(done)
+
+			fakeInfluxDB.UseV2("secret")
+			config.InfluxDbVersion = "2"
+			config.InfluxDbOrg = "org"
+			config.InfluxDbBucket = "bucket"
+			config.InfluxDbToken = "secret"
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000
+`))
+			Expect(fakeInfluxDB.LastQuery().Get("org")).To(Equal("org"))
+			Expect(fakeInfluxDB.LastQuery().Get("bucket")).To(Equal("bucket"))
+			Expect(fakeInfluxDB.LastQuery().Get("precision")).To(Equal("ns"))
+		}, 2)
+
+		It("Keep batches rejected because of the InfluxDB 2.x token", func(done Done) {
+			defer close(done)
+
+			fakeInfluxDB.UseV2("secret")
+			config.InfluxDbVersion = "2"
+			config.InfluxDbOrg = "org"
+			config.InfluxDbBucket = "bucket"
+			config.InfluxDbToken = "wrong"
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+
+			startNozzle()
+
+			Expect(fakeBuffer.GetContent()).To(MatchRegexp("InfluxDB rejected the write, check the database.*unauthorized access"))
+			Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("retrying"))
+			Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("Dropping"))
+
+			// The kept points are written once the token is fixed.
+			config.InfluxDbToken = "secret"
+			startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+			Expect(withoutInternalMetrics(contents)).To(HavePrefix(
+				`datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000
+`))
+		}, 5)
+
+		It("Fails to start with retention policies for InfluxDB 2.x", func() {
+			config.InfluxDbVersion = "2"
+			config.InfluxDbOrg = "org"
+			config.RoutingRules = []nozzleconfig.RoutingRule{
+				{Field: "job", Value: "doppler", Database: "tenant", RetentionPolicy: "short"},
+			}
+			nozzle = NewInfluxDBFirehoseNozzle(config, tokenFetcher, log)
+			Expect(nozzle.Start()).To(MatchError("Invalid routing rule 0: RetentionPolicy can't be used with InfluxDbVersion 2"))
+
+			config.RoutingRules = nil
+			config.RetentionPolicy = "short"
+			nozzle = NewInfluxDBFirehoseNozzle(config, tokenFetcher, log)
+			Expect(nozzle.Start()).To(MatchError("RetentionPolicy can't be used with InfluxDbVersion 2"))
+		})
+
+		It("Fails to start without InfluxDB 2.x org", func() {
+			config.InfluxDbVersion = "2"
+			Expect(nozzle.Start()).To(HaveOccurred())
+		})
+
+		It("Write via UDP", func(done Done) {
 			defer close(done)
 
+			fakeUDP := NewFakeInfluxDBUDP()
+			fakeUDP.Start()
+			defer fakeUDP.Close()
+
+			config.InfluxDbUDPAddress = fakeUDP.Addr()
+			config.InfluxDbUDPPayloadSize = 200
 			for i := 0; i < 10; i++ {
-				envelope := events.Envelope{
-					Origin:    proto.String("origin"),
-					Timestamp: proto.Int64(1000000000),
-					EventType: events.Envelope_ValueMetric.Enum(),
-					ValueMetric: &events.ValueMetric{
-						Name:  proto.String(fmt.Sprintf("metricName-%d", i)),
-						Value: proto.Float64(float64(i)),
-						Unit:  proto.String("gauge"),
-					},
-					Deployment: proto.String("deployment-name"),
-					Job:        proto.String("doppler"),
-				}
-				fakeFirehose.AddEvent(envelope)
+				fakeFirehose.AddEvent(taggedValueMetricEnvelope(i))
 			}
 
-			fakeFirehose.SetCloseMessage(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Client did not respond to ping before keep-alive timeout expired."))
+			go startNozzle()
 
-			go nozzle.Start()
+			metrics := 0
+			for metrics < 10 {
+				var contents []byte
+				Eventually(fakeUDP.ReceivedContents).Should(Receive(&contents))
+				Expect(len(contents)).To(BeNumerically("<=", 200))
+				metrics += strings.Count(string(contents), "origin.metricName")
+			}
+			Expect(metrics).To(Equal(10))
+			Consistently(fakeInfluxDB.ReceivedContents).ShouldNot(Receive())
+		}, 3)
 
+		It("Fails to start with routing rules via UDP", func() {
+			config.InfluxDbUDPAddress = "127.0.0.1:8089"
+			config.RoutingRules = []nozzleconfig.RoutingRule{
+				{Field: "origin", Value: "origin", Database: "other"},
+			}
+			nozzle = NewInfluxDBFirehoseNozzle(config, tokenFetcher, log)
+			Expect(nozzle.Start()).To(MatchError("RoutingRules can't be used with InfluxDbUDPAddress"))
+		})
+
+		It("Fails to start with precision via UDP", func() {
+			config.InfluxDbUDPAddress = "127.0.0.1:8089"
+			config.WriteOverrides = []nozzleconfig.WriteOverride{
+				{Match: "regex", Measurement: "ContainerMetric$", Precision: "s"},
+			}
+			nozzle = NewInfluxDBFirehoseNozzle(config, tokenFetcher, log)
+			Expect(nozzle.Start()).To(MatchError("Invalid write override 0: Precision can't be used with InfluxDbUDPAddress"))
+		})
+
+		It("Write with retention policy, consistency and precision", func(done Done) {
+			defer close(done)
+
+			config.RetentionPolicy = "short"
+			config.WriteConsistency = "all"
+			config.Precision = "s"
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+
+			go startNozzle()
 			var contents []byte
 			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
 
-			logOutput := fakeBuffer.GetContent()
-			Expect(logOutput).To(ContainSubstring("Reconnecting"))
-		})
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1
+`))
+			Expect(fakeInfluxDB.LastQuery().Get("rp")).To(Equal("short"))
+			Expect(fakeInfluxDB.LastQuery().Get("consistency")).To(Equal("all"))
+			Expect(fakeInfluxDB.LastQuery().Get("precision")).To(Equal("s"))
+		}, 2)
+
+		It("Override the retention policy per measurement", func(done Done) {
+			defer close(done)
+
+			config.RetentionPolicy = "short"
+			config.WriteOverrides = []nozzleconfig.WriteOverride{
+				{Match: "regex", Measurement: "ContainerMetric$", RetentionPolicy: "apps"},
+			}
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeFirehose.AddEvent(events.Envelope{
+				Origin:    proto.String("rep"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ContainerMetric.Enum(),
+				ContainerMetric: &events.ContainerMetric{
+					ApplicationId: proto.String("app-id"),
+					InstanceIndex: proto.Int32(0),
+					CpuPercentage: proto.Float64(1),
+					MemoryBytes:   proto.Uint64(1),
+					DiskBytes:     proto.Uint64(1),
+				},
+			})
+
+			go startNozzle()
+
+			received := []string{}
+			for len(received) < 2 {
+				var contents []byte
+				Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+				received = append(received, withoutInternalMetrics(contents))
+			}
+			Expect(received).To(ConsistOf(
+				HavePrefix("datadog.nozzle.origin.metricName,"),
+				HavePrefix("datadog.nozzle.rep.ContainerMetric,"),
+			))
+
+			rps := []string{}
+			for _, q := range fakeInfluxDB.Queries() {
+				rps = append(rps, q.Get("rp"))
+			}
+			Expect(rps).To(ConsistOf("short", "apps"))
+		}, 2)
+
+		It("Fails to start with unsupported precision", func() {
+			config.Precision = "u"
+			Expect(nozzle.Start()).To(HaveOccurred())
+		})
+
+		It("Route points to databases by rule", func(done Done) {
+			defer close(done)
+
+			config.InfluxDbDatabase = "cf"
+			config.RoutingRules = []nozzleconfig.RoutingRule{
+				{Field: "tag", Tag: "request_id", Value: "r-1", Database: "tenant-a", RetentionPolicy: "short"},
+				{Field: "origin", Match: "prefix", Value: "tenant", Database: "tenant-b"},
+			}
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(1))
+			envelope := taggedValueMetricEnvelope(2)
+			envelope.Origin = proto.String("tenant-b-app")
+			fakeFirehose.AddEvent(envelope)
+
+			go startNozzle()
+
+			received := []string{}
+			for len(received) < 3 {
+				var contents []byte
+				Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+				received = append(received, withoutInternalMetrics(contents))
+			}
+			Expect(received).To(ConsistOf(
+				HavePrefix("datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 "),
+				HavePrefix("datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-1 "),
+				HavePrefix("datadog.nozzle.tenant-b-app.metricName,deployment=deployment-name,job=doppler,request_id=r-2 "),
+			))
+
+			destinations := []string{}
+			for _, q := range fakeInfluxDB.Queries() {
+				destinations = append(destinations, q.Get("db")+"/"+q.Get("rp"))
+			}
+			Expect(destinations).To(ConsistOf("cf/", "tenant-a/short", "tenant-b/"))
+		}, 2)
+
+		It("Fails to start with routing rules without destination", func() {
+			config.RoutingRules = []nozzleconfig.RoutingRule{{Field: "origin", Value: "origin"}}
+			Expect(nozzle.Start()).To(HaveOccurred())
+		})
+
+		It("Create missing databases and retention policies", func(done Done) {
+			defer close(done)
+
+			config.InfluxDbDatabase = "cf"
+			config.CreateDatabase = true
+			config.RetentionPolicies = []nozzleconfig.RetentionPolicy{
+				{Name: "short", Duration: "1d", ShardGroupDuration: "1h", Default: true},
+				{Name: "apps", Duration: "30d", Replication: 2},
+			}
+			config.RoutingRules = []nozzleconfig.RoutingRule{
+				{Field: "origin", Value: "tenant", Database: "tenant-a"},
+			}
+			fakeInfluxDB.AddDatabase("tenant-a", "autogen", "apps")
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+
+			go startNozzle()
+
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive())
+			Expect(fakeInfluxDB.Statements()).To(Equal([]string{
+				`SHOW DATABASES`,
+				`CREATE DATABASE "cf"`,
+				`SHOW RETENTION POLICIES ON "cf"`,
+				`CREATE RETENTION POLICY "short" ON "cf" DURATION 1d REPLICATION 1 SHARD DURATION 1h DEFAULT`,
+				`CREATE RETENTION POLICY "apps" ON "cf" DURATION 30d REPLICATION 2`,
+				`SHOW RETENTION POLICIES ON "tenant-a"`,
+				`CREATE RETENTION POLICY "short" ON "tenant-a" DURATION 1d REPLICATION 1 SHARD DURATION 1h DEFAULT`,
+			}))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("Created database cf on " + fakeInfluxDB.URL()))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("Created retention policy short of database tenant-a on " + fakeInfluxDB.URL() + ": duration 1d, replication 1, shard group duration 1h, default"))
+			Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("Created database tenant-a"))
+		}, 2)
+
+		It("Fails to start if the database can't be created", func() {
+			config.CreateDatabase = true
+			fakeInfluxDB.Close()
+			Expect(nozzle.Start()).To(HaveOccurred())
+		})
+
+		Context("with multiple endpoints", func() {
+			var secondInfluxDB *FakeInfluxDB
+
+			BeforeEach(func() {
+				secondInfluxDB = NewFakeInfluxDB()
+				secondInfluxDB.Start()
+				config.InfluxDbEndpoints = []nozzleconfig.InfluxDbEndpoint{
+					{URL: fakeInfluxDB.URL()},
+					{URL: secondInfluxDB.URL()},
+				}
+				config.RetryInitialBackoffMillis = 10
+				fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			})
+
+			AfterEach(func() {
+				secondInfluxDB.Close()
+			})
+
+			It("Mirror batches to all endpoints", func(done Done) {
+				defer close(done)
+
+				config.EndpointMode = "mirror"
+				go startNozzle()
+
+				var contents []byte
+				Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+				Expect(withoutInternalMetrics(contents)).Should(HavePrefix("datadog.nozzle.origin.metricName,"))
+				Eventually(secondInfluxDB.ReceivedContents).Should(Receive(&contents))
+				Expect(withoutInternalMetrics(contents)).Should(HavePrefix("datadog.nozzle.origin.metricName,"))
+				Expect(string(contents)).Should(ContainSubstring("datadog.nozzle.endpointHealthy,endpoint=" + secondInfluxDB.URL() + " value=1"))
+			}, 2)
+
+			It("Mirror batches while an endpoint is down", func(done Done) {
+				defer close(done)
+
+				config.EndpointMode = "mirror"
+				fakeInfluxDB.Close()
+				go startNozzle()
+
+				var contents []byte
+				Eventually(secondInfluxDB.ReceivedContents).Should(Receive(&contents))
+				Expect(withoutInternalMetrics(contents)).Should(HavePrefix("datadog.nozzle.origin.metricName,"))
+				Eventually(fakeBuffer.GetContent).Should(ContainSubstring("InfluxDB endpoint " + fakeInfluxDB.URL() + " is unhealthy"))
+				Expect(fakeBuffer.GetContent()).NotTo(ContainSubstring("Writing to InfluxDB failed"))
+			}, 2)
+
+			It("Write missed batches to an endpoint once it recovered", func(done Done) {
+				defer close(done)
+
+				config.EndpointMode = "mirror"
+				fakeInfluxDB.FailNextWrites(1, http.StatusServiceUnavailable, `{"error":"timeout"}`)
+				startNozzle()
+
+				var contents []byte
+				Eventually(secondInfluxDB.ReceivedContents).Should(Receive(&contents))
+				Expect(withoutInternalMetrics(contents)).Should(HavePrefix("datadog.nozzle.origin.metricName,"))
+				Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+				Expect(withoutInternalMetrics(contents)).Should(HavePrefix("datadog.nozzle.origin.metricName,"))
+				Expect(fakeInfluxDB.FailedWrites()).To(Equal(1))
+			}, 2)
+
+			It("Drop missed batches an endpoint can't write on shutdown", func(done Done) {
+				defer close(done)
+
+				config.EndpointMode = "mirror"
+				fakeInfluxDB.Close()
+				startNozzle()
+
+				Expect(fakeBuffer.GetContent()).To(ContainSubstring("points InfluxDB endpoint " + fakeInfluxDB.URL() + " did not receive"))
+			}, 2)
+
+			It("Fail over to the next endpoint", func(done Done) {
+				defer close(done)
+
+				config.EndpointMode = "failover"
+				fakeInfluxDB.FailNextWrites(1, http.StatusServiceUnavailable, `{"error":"timeout"}`)
+				go startNozzle()
+
+				var contents []byte
+				Eventually(secondInfluxDB.ReceivedContents).Should(Receive(&contents))
+				Expect(withoutInternalMetrics(contents)).Should(HavePrefix("datadog.nozzle.origin.metricName,"))
+				Expect(fakeBuffer.GetContent()).To(ContainSubstring("InfluxDB endpoint " + fakeInfluxDB.URL() + " is unhealthy"))
+				Consistently(fakeInfluxDB.ReceivedContents).ShouldNot(Receive())
+			}, 2)
+		})
+
+		It("Serve health endpoints on $PORT", func(done Done) {
+			defer close(done)
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			addr := l.Addr().String()
+			l.Close()
+			_, port, _ := net.SplitHostPort(addr)
+			os.Setenv("PORT", port)
+			defer os.Unsetenv("PORT")
+
+			config.HealthBindAddress = "127.0.0.1"
+			config.RetryMaxAttempts = 3
+			config.RetryInitialBackoffMillis = 500
+			fakeInfluxDB.Close()
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+
+			finished := make(chan error)
+			go func() {
+				finished <- startNozzle()
+			}()
+
+			get := func(path string) (int, string) {
+				resp, err := http.Get("http://" + addr + path)
+				if err != nil {
+					return 0, err.Error()
+				}
+				defer resp.Body.Close()
+				body, _ := ioutil.ReadAll(resp.Body)
+				return resp.StatusCode, string(body)
+			}
+
+			Eventually(func() int {
+				code, _ := get("/healthz")
+				return code
+			}).Should(Equal(http.StatusOK))
+
+			var status map[string]interface{}
+			Eventually(func() interface{} {
+				_, body := get("/status")
+				status = nil
+				json.Unmarshal([]byte(body), &status)
+				return status["lastError"]
+			}).ShouldNot(BeNil())
+			Expect(status["firehose"]).To(Equal("disconnected"))
+			Expect(status["ready"]).To(Equal(false))
+			Expect(status["messagesReceived"]).To(BeEquivalentTo(1))
+			Expect(status).To(HaveKey("batchSize"))
+
+			code, _ := get("/readyz")
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+
+			Eventually(finished, 5).Should(Receive())
+			code, _ = get("/healthz")
+			Expect(code).To(BeZero())
+		}, 10)
+
+		It("Catch slow consumer alerts", func(done Done) {
+			defer close(done)
+
+			envelope := events.Envelope{
+				Origin:    proto.String("doppler"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_CounterEvent.Enum(),
+				CounterEvent: &events.CounterEvent{
+					Name:  proto.String("TruncatingBuffer.DroppedMessages"),
+					Delta: proto.Uint64(1),
+					Total: proto.Uint64(10),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+			}
+			fakeFirehose.AddEvent(envelope)
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(string(contents)).Should(MatchRegexp("datadog.nozzle.slowConsumerAlert value=1 \\d+\n"))
+			Expect(string(contents)).Should(ContainSubstring("datadog.nozzle.doppler.TruncatingBuffer.DroppedMessages,deployment=deployment-name,job=doppler delta=1,total=10,value=10 1000000000\n"))
+		}, 2)
+
+		It("Apply metric prefix with separator", func(done Done) {
+			defer close(done)
+
+			config.MetricPrefix = "cf"
+			config.MetricPrefixSeparator = "_"
+			fakeFirehose.AddEvent(events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(1),
+					Unit:  proto.String("gauge"),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+			})
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`cf_origin.metricName,deployment=deployment-name,job=doppler value=1 1000000000
+`))
+		}, 2)
+
+		It("Apply measurement and tag templates", func(done Done) {
+			defer close(done)
+
+			config.MeasurementTemplate = "{origin}"
+			config.TagTemplates = map[string]string{
+				"name": "{name}",
+				"type": "{event_type}",
+			}
+			for i := 0; i < 2; i++ {
+				fakeFirehose.AddEvent(events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String(fmt.Sprintf("metricName-%d", i)),
+						Value: proto.Float64(float64(i)),
+						Unit:  proto.String("gauge"),
+					},
+					Deployment: proto.String("deployment-name"),
+					Job:        proto.String("doppler"),
+				})
+			}
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.origin,deployment=deployment-name,job=doppler,name=metricName-0,type=ValueMetric value=0 1000000000
+datadog.nozzle.origin,deployment=deployment-name,job=doppler,name=metricName-1,type=ValueMetric value=1 1000000000
+`))
+		}, 2)
+
+		It("Keep placeholders within template values", func(done Done) {
+			defer close(done)
+
+			config.MeasurementTemplate = "{origin}_{job}"
+			config.TagTemplates = map[string]string{
+				"source": "{deployment}",
+			}
+			envelope := taggedValueMetricEnvelope(0)
+			envelope.Origin = proto.String("{job}")
+			envelope.Deployment = proto.String("{origin}")
+			fakeFirehose.AddEvent(envelope)
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.{job}_doppler,deployment={origin},job=doppler,request_id=r-0,source={origin} value=0 1000000000
+`))
+		}, 2)
+
+		It("Use a fixed measurement per event type", func(done Done) {
+			defer close(done)
+
+			config.MeasurementTemplate = "{event_type}"
+			fakeFirehose.AddEvent(errorEnvelope())
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.Error,code=42,deployment=deployment-name,job=doppler,origin=doppler,source=dropsonde count=1 1000000000
+`))
+		}, 2)
+
+		It("Reject envelopes whose measurement template expands to an empty name", func() {
+			config.MeasurementTemplate = "{job}"
+			envelope := taggedValueMetricEnvelope(0)
+			envelope.Job = nil
+
+			Expect(nozzle.AddMetric(&envelope)).To(MatchError("Measurement template {job} expands to an empty name"))
+		})
+
+		It("Filter envelopes", func(done Done) {
+			defer close(done)
+
+			config.Filters = []nozzleconfig.FilterRule{
+				{Action: nozzleconfig.FilterInclude, Field: "origin", Value: "origin"},
+				{Action: nozzleconfig.FilterExclude, Field: "name", Match: nozzleconfig.MatchRegex, Value: "-1$"},
+				{Action: nozzleconfig.FilterExclude, Field: "tag", Tag: "source", Match: nozzleconfig.MatchPrefix, Value: "test"},
+			}
+			for i := 0; i < 3; i++ {
+				fakeFirehose.AddEvent(events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String(fmt.Sprintf("metricName-%d", i)),
+						Value: proto.Float64(float64(i)),
+						Unit:  proto.String("gauge"),
+					},
+					Deployment: proto.String("deployment-name"),
+					Job:        proto.String("doppler"),
+				})
+			}
+			fakeFirehose.AddEvent(events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName-3"),
+					Value: proto.Float64(3),
+					Unit:  proto.String("gauge"),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+				Tags:       map[string]string{"source": "testing"},
+			})
+			fakeFirehose.AddEvent(errorEnvelope())
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(string(contents)).Should(HavePrefix(
+				`datadog.nozzle.origin.metricName-0,deployment=deployment-name,job=doppler value=0 1000000000
+datadog.nozzle.origin.metricName-2,deployment=deployment-name,job=doppler value=2 1000000000
+`))
+			Expect(string(contents)).Should(MatchRegexp(`datadog.nozzle.filteredEnvelopes,rule=1 value=1 \d+\n`))
+			Expect(string(contents)).Should(MatchRegexp(`datadog.nozzle.filteredEnvelopes,rule=2 value=1 \d+\n`))
+			Expect(string(contents)).Should(MatchRegexp(`datadog.nozzle.filteredEnvelopes,rule=no_include_match value=1 \d+\n`))
+		}, 2)
+
+		It("Fails to start with invalid filter rules", func() {
+			config.Filters = []nozzleconfig.FilterRule{
+				{Field: "name", Match: nozzleconfig.MatchRegex, Value: "("},
+			}
+			nozzle = NewInfluxDBFirehoseNozzle(config, tokenFetcher, log)
+			Expect(nozzle.Start()).To(HaveOccurred())
+		})
+
+		It("Relabel tags", func(done Done) {
+			defer close(done)
+
+			config.RelabelRules = []nozzleconfig.RelabelRule{
+				{Action: nozzleconfig.RelabelDrop, SourceTags: []string{"ip"}},
+				{Action: nozzleconfig.RelabelDrop, Regex: "tmp-.*"},
+				{Action: nozzleconfig.RelabelRename, SourceTags: []string{"job"}, TargetTag: "component"},
+				{
+					SourceTags:  []string{"__name__"},
+					Regex:       "metricName-(\\d+)",
+					TargetTag:   "number",
+					Replacement: "n$1",
+					Tags:        map[string]string{"foundation": "eu"},
+				},
+			}
+			fakeFirehose.AddEvent(events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName-7"),
+					Value: proto.Float64(7),
+					Unit:  proto.String("gauge"),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+				Ip:         proto.String("10.0.0.1"),
+				Tags:       map[string]string{"tmp-id": "123"},
+			})
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.origin.metricName-7,component=doppler,deployment=deployment-name,foundation=eu,number=n7 value=7 1000000000
+`))
+		}, 2)
+
+		It("Collapse tag values exceeding the cardinality limit", func(done Done) {
+			defer close(done)
+
+			config.MaxValuesPerTag = 2
+			for i := 0; i < 4; i++ {
+				fakeFirehose.AddEvent(taggedValueMetricEnvelope(i))
+			}
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(MatchRegexp(
+				`^datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000
+datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-1 value=1 1000000000
+datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=__overflow__ value=2 1000000000
+datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=__overflow__ value=3 1000000000
+datadog.nozzle.cardinalityLimited,measurement=datadog.nozzle.origin.metricName,tag=request_id value=2 \d+
+$`))
+		}, 2)
+
+		It("Drop series exceeding the cardinality limit", func(done Done) {
+			defer close(done)
+
+			config.MaxSeriesPerMeasurement = 2
+			for i := 0; i < 4; i++ {
+				fakeFirehose.AddEvent(taggedValueMetricEnvelope(i % 3))
+			}
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(MatchRegexp(
+				`^datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000
+datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-1 value=1 1000000000
+datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000
+datadog.nozzle.cardinalityLimited,measurement=datadog.nozzle.origin.metricName value=1 \d+
+$`))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("Measurement datadog.nozzle.origin.metricName exceeds 2 series"))
+		}, 2)
+
+		It("Don't count tag values of dropped points against the limit", func(done Done) {
+			defer close(done)
+
+			config.MaxSeriesPerMeasurement = 1
+			config.MaxValuesPerTag = 2
+			config.CardinalityOverflowAction = nozzleconfig.CardinalityDrop
+			for i := 0; i < 3; i++ {
+				fakeFirehose.AddEvent(taggedValueMetricEnvelope(i))
+			}
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			// r-1 is dropped by the series limit, so r-2 doesn't exceed the
+			// tag value limit.
+			Expect(withoutInternalMetrics(contents)).Should(MatchRegexp(
+				`^datadog.nozzle.origin.metricName,deployment=deployment-name,job=doppler,request_id=r-0 value=0 1000000000
+datadog.nozzle.cardinalityLimited,measurement=datadog.nozzle.origin.metricName value=2 \d+
+$`))
+		}, 2)
+
+		It("Fails to start with unsupported cardinality overflow action", func() {
+			config.CardinalityOverflowAction = "truncate"
+			nozzle = NewInfluxDBFirehoseNozzle(config, tokenFetcher, log)
+			Expect(nozzle.Start()).To(MatchError("Unsupported cardinality overflow action truncate"))
+		})
+
+		It("Compute counter rates", func(done Done) {
+			defer close(done)
+
+			config.CounterRates = true
+			for i, total := range []uint64{10, 30, 5} {
+				fakeFirehose.AddEvent(events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(int64(i+1) * 1000000000),
+					EventType: events.Envelope_CounterEvent.Enum(),
+					CounterEvent: &events.CounterEvent{
+						Name:  proto.String("requests"),
+						Delta: proto.Uint64(5),
+						Total: proto.Uint64(total),
+					},
+					Deployment: proto.String("deployment-name"),
+					Job:        proto.String("doppler"),
+				})
+			}
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.origin.requests,deployment=deployment-name,job=doppler delta=5,total=10,value=10 1000000000
+datadog.nozzle.origin.requests,deployment=deployment-name,job=doppler delta=5,rate=20,total=30,value=30 2000000000
+datadog.nozzle.origin.requests,deployment=deployment-name,job=doppler delta=5,rate=5,total=5,value=5 3000000000
+`))
+		}, 2)
+
+		It("Compute counter rates of collapsed series", func(done Done) {
+			defer close(done)
+
+			config.CounterRates = true
+			config.MaxValuesPerTag = 1
+			for i, total := range []uint64{10, 30, 40} {
+				fakeFirehose.AddEvent(events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(int64(i+1) * 1000000000),
+					EventType: events.Envelope_CounterEvent.Enum(),
+					CounterEvent: &events.CounterEvent{
+						Name:  proto.String("requests"),
+						Delta: proto.Uint64(5),
+						Total: proto.Uint64(total),
+					},
+					Deployment: proto.String("deployment-name"),
+					Job:        proto.String("doppler"),
+					Tags:       map[string]string{"request_id": fmt.Sprintf("r-%d", i)},
+				})
+			}
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(MatchRegexp(
+				`^datadog.nozzle.origin.requests,deployment=deployment-name,job=doppler,request_id=r-0 delta=5,total=10,value=10 1000000000
+datadog.nozzle.origin.requests,deployment=deployment-name,job=doppler,request_id=__overflow__ delta=5,total=30,value=30 2000000000
+datadog.nozzle.origin.requests,deployment=deployment-name,job=doppler,request_id=__overflow__ delta=5,rate=10,total=40,value=40 3000000000
+datadog.nozzle.cardinalityLimited,measurement=datadog.nozzle.origin.requests,tag=request_id value=2 \d+
+$`))
+		}, 2)
+
+		It("Add container metrics", func(done Done) {
+			defer close(done)
+
+			envelope := events.Envelope{
+				Origin:    proto.String("rep"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ContainerMetric.Enum(),
+				ContainerMetric: &events.ContainerMetric{
+					ApplicationId:    proto.String("app-id"),
+					InstanceIndex:    proto.Int32(2),
+					CpuPercentage:    proto.Float64(12.5),
+					MemoryBytes:      proto.Uint64(1024),
+					DiskBytes:        proto.Uint64(2048),
+					MemoryBytesQuota: proto.Uint64(8192),
+					DiskBytesQuota:   proto.Uint64(4096),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("diego_cell"),
+			}
+			fakeFirehose.AddEvent(envelope)
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.rep.ContainerMetric,application_id=app-id,deployment=deployment-name,instance_index=2,job=diego_cell cpu_percentage=12.5,disk_bytes=2048,disk_bytes_quota=4096,memory_bytes=1024,memory_bytes_quota=8192 1000000000
+`))
+		}, 2)
+
+		It("Add HttpStartStop points", func(done Done) {
+			defer close(done)
+
+			config.HttpMetrics = nozzleconfig.HttpMetricsPoints
+			fakeFirehose.AddEvent(httpStartStopEnvelope(5))
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.gorouter.HttpStartStop,application_id=01000000-0000-0000-0200-000000000000,deployment=deployment-name,job=router,method=GET,peer_type=Client,status_class=2xx duration_ms=5,status_code=200 1000000000
+`))
+		}, 2)
+
+		It("Aggregate HttpStartStop events", func(done Done) {
+			defer close(done)
+
+			config.HttpMetrics = nozzleconfig.HttpMetricsAggregate
+			for _, d := range []int64{5, 10, 15} {
+				fakeFirehose.AddEvent(httpStartStopEnvelope(d))
+			}
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(MatchRegexp(
+				`^datadog.nozzle.gorouter.HttpStartStop,application_id=01000000-0000-0000-0200-000000000000,deployment=deployment-name,peer_type=Client,status_class=2xx count=3,duration_ms_max=15,duration_ms_min=5,duration_ms_sum=30 \d+\n$`))
+			Expect(string(contents)).Should(MatchRegexp(`\.batchSize value=1 \d+\n`))
+		}, 2)
+
+		It("Ignore none numeric events", func(done Done) {
+			defer close(done)
+			envelope := events.Envelope{
+				Origin:    proto.String("doppler"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_LogMessage.Enum(),
+				LogMessage: &events.LogMessage{
+					Message:     []byte("FOO"),
+					MessageType: events.LogMessage_OUT.Enum(),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+			}
+			fakeFirehose.AddEvent(envelope)
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(``))
+		}, 2)
+
+		It("Forward log messages if enabled", func(done Done) {
+			defer close(done)
+
+			config.EnableLogMessages = true
+			config.LogMessageMaxBytes = 5
+			fakeFirehose.AddEvent(logMessageEnvelope("FOOBARBAZ"))
+			fakeFirehose.AddEvent(logMessageEnvelope("BAR"))
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.logs,app_id=app-id,deployment=deployment-name,job=doppler,message_type=OUT,source_instance=0,source_type=APP message="FOOBA",truncated=true 1000000000
+datadog.nozzle.logs,app_id=app-id,deployment=deployment-name,job=doppler,message_type=OUT,source_instance=0,source_type=APP message="BAR" 1000000000
+`))
+		}, 2)
+
+		It("Limit log messages per flush", func(done Done) {
+			defer close(done)
+
+			config.EnableLogMessages = true
+			config.LogMessagesMeasurement = "app_logs"
+			config.LogMessagesMaxPerFlush = 1
+			fakeFirehose.AddEvent(logMessageEnvelope("FOO"))
+			fakeFirehose.AddEvent(logMessageEnvelope("BAR"))
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.app_logs,app_id=app-id,deployment=deployment-name,job=doppler,message_type=OUT,source_instance=0,source_type=APP message="FOO" 1000000000
+`))
+		}, 2)
+
+		It("Count error events", func(done Done) {
+			defer close(done)
+
+			fakeFirehose.AddEvent(errorEnvelope())
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.errors,code=42,deployment=deployment-name,job=doppler,origin=doppler,source=dropsonde count=1 1000000000
+`))
+		}, 2)
+
+		It("Include error messages if enabled", func(done Done) {
+			defer close(done)
+
+			config.IncludeErrorMessages = true
+			fakeFirehose.AddEvent(errorEnvelope())
+
+			go startNozzle()
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.errors,code=42,deployment=deployment-name,job=doppler,origin=doppler,source=dropsonde count=1,message="something failed" 1000000000
+`))
+		}, 2)
+
+		It("Add tags", func(done Done) {
+			defer close(done)
+
+			for i := 0; i < 3; i++ {
+				envelope := events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String(fmt.Sprintf("metricName-%d", i)),
+						Value: proto.Float64(float64(i)),
+						Unit:  proto.String("gauge"),
+					},
+					Deployment: proto.String("deployment-name"),
+					Job:        proto.String("doppler"),
+					Tags: map[string]string{
+						fmt.Sprintf("tag-%d", i): "tagsvalue",
+						fmt.Sprintf("tag-%d", i): "tagsvalue",
+					},
+				}
+				fakeFirehose.AddEvent(envelope)
+			}
+
+			go startNozzle()
+
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			Expect(fakeBuffer.GetContent()).ToNot(ContainSubstring("Error while reading from the firehose"))
+			// internal metrics like totalMessagesReceived and slowConsumerAlert are written on every flush
+			Expect(withoutInternalMetrics(contents)).Should(Equal(
+				`datadog.nozzle.origin.metricName-0,deployment=deployment-name,job=doppler,tag-0=tagsvalue value=0 1000000000
+datadog.nozzle.origin.metricName-1,deployment=deployment-name,job=doppler,tag-1=tagsvalue value=1 1000000000
+datadog.nozzle.origin.metricName-2,deployment=deployment-name,job=doppler,tag-2=tagsvalue value=2 1000000000
+`))
+
+		}, 2)
+
+		It("Handle RetryError", func(done Done) {
+			defer close(done)
+
+			for i := 0; i < 10; i++ {
+				envelope := events.Envelope{
+					Origin:    proto.String("origin"),
+					Timestamp: proto.Int64(1000000000),
+					EventType: events.Envelope_ValueMetric.Enum(),
+					ValueMetric: &events.ValueMetric{
+						Name:  proto.String(fmt.Sprintf("metricName-%d", i)),
+						Value: proto.Float64(float64(i)),
+						Unit:  proto.String("gauge"),
+					},
+					Deployment: proto.String("deployment-name"),
+					Job:        proto.String("doppler"),
+				}
+				fakeFirehose.AddEvent(envelope)
+			}
+
+			fakeFirehose.SetCloseMessage(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Client did not respond to ping before keep-alive timeout expired."))
+
+			go startNozzle()
+
+			var contents []byte
+			Eventually(fakeInfluxDB.ReceivedContents).Should(Receive(&contents))
+
+			logOutput := fakeBuffer.GetContent()
+			Expect(logOutput).To(ContainSubstring("Reconnecting"))
+			Expect(string(contents)).To(MatchRegexp("datadog.nozzle.slowConsumerAlert value=1 \\d+\n"))
+		})
+
+		It("Reset slowConsumerAlert after a healthy interval", func(done Done) {
+			defer close(done)
+
+			config.FlushDurationSeconds = 1
+			config.SlowConsumerResetSeconds = 2
+			fakeFirehose.AddEvent(taggedValueMetricEnvelope(0))
+			fakeFirehose.SetCloseMessage(websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Client did not respond to ping before keep-alive timeout expired."))
+
+			go nozzle.Start()
+			Eventually(fakeBuffer.GetContent).Should(ContainSubstring("Reconnecting"))
+			// The nozzle keeps running and reconnecting while the firehose
+			// is gone, without further policy violations.
+			fakeFirehose.Close()
+
+			nextFlush := func() string {
+				select {
+				case contents := <-fakeInfluxDB.ReceivedContents:
+					return string(contents)
+				default:
+					return ""
+				}
+			}
+			Eventually(nextFlush, 3).Should(MatchRegexp("datadog.nozzle.slowConsumerAlert value=1 \\d+\n"))
+			Eventually(nextFlush, 4).Should(MatchRegexp("datadog.nozzle.slowConsumerAlert value=0 \\d+\n"))
+			Expect(fakeBuffer.GetContent()).To(ContainSubstring("resetting slowConsumerAlert"))
+		}, 10)
 
 	})
 })
+
+func httpStartStopEnvelope(durationMillis int64) events.Envelope {
+	return events.Envelope{
+		Origin:    proto.String("gorouter"),
+		Timestamp: proto.Int64(1000000000),
+		EventType: events.Envelope_HttpStartStop.Enum(),
+		HttpStartStop: &events.HttpStartStop{
+			StartTimestamp: proto.Int64(1000000000),
+			StopTimestamp:  proto.Int64(1000000000 + durationMillis*1000000),
+			RequestId: &events.UUID{
+				Low:  proto.Uint64(3),
+				High: proto.Uint64(4),
+			},
+			PeerType:      events.PeerType_Client.Enum(),
+			Method:        events.Method_GET.Enum(),
+			Uri:           proto.String("http://app.example.com/"),
+			RemoteAddress: proto.String("10.0.0.1:4567"),
+			UserAgent:     proto.String("curl"),
+			StatusCode:    proto.Int32(200),
+			ContentLength: proto.Int64(42),
+			ApplicationId: &events.UUID{
+				Low:  proto.Uint64(1),
+				High: proto.Uint64(2),
+			},
+		},
+		Deployment: proto.String("deployment-name"),
+		Job:        proto.String("router"),
+	}
+}
+
+func logMessageEnvelope(message string) events.Envelope {
+	return events.Envelope{
+		Origin:    proto.String("doppler"),
+		Timestamp: proto.Int64(1000000000),
+		EventType: events.Envelope_LogMessage.Enum(),
+		LogMessage: &events.LogMessage{
+			Message:        []byte(message),
+			MessageType:    events.LogMessage_OUT.Enum(),
+			Timestamp:      proto.Int64(1000000000),
+			AppId:          proto.String("app-id"),
+			SourceType:     proto.String("APP"),
+			SourceInstance: proto.String("0"),
+		},
+		Deployment: proto.String("deployment-name"),
+		Job:        proto.String("doppler"),
+	}
+}
+
+func errorEnvelope() events.Envelope {
+	return events.Envelope{
+		Origin:    proto.String("doppler"),
+		Timestamp: proto.Int64(1000000000),
+		EventType: events.Envelope_Error.Enum(),
+		Error: &events.Error{
+			Source:  proto.String("dropsonde"),
+			Code:    proto.Int32(42),
+			Message: proto.String("something failed"),
+		},
+		Deployment: proto.String("deployment-name"),
+		Job:        proto.String("doppler"),
+	}
+}
+
+func taggedValueMetricEnvelope(i int) events.Envelope {
+	return events.Envelope{
+		Origin:    proto.String("origin"),
+		Timestamp: proto.Int64(1000000000),
+		EventType: events.Envelope_ValueMetric.Enum(),
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String("metricName"),
+			Value: proto.Float64(float64(i)),
+			Unit:  proto.String("gauge"),
+		},
+		Deployment: proto.String("deployment-name"),
+		Job:        proto.String("doppler"),
+		Tags:       map[string]string{"request_id": fmt.Sprintf("r-%d", i)},
+	}
+}
+
+// internalMetrics are written by the nozzle on every flush.
+var internalMetrics = []string{
+	"totalMessagesReceived", "totalPointsWritten", "totalPointsDropped", "totalWriteErrors", "totalReconnects",
+	"batchSize", "flushLatencyMs", "slowConsumerAlert",
+	"writeQueueDepth", "writesInFlight", "writeLatencyMs", "writeLatencyMaxMs", "endpointHealthy", "endpointSkippedBatches", "endpointDroppedBatches",
+}
+
+// countLines returns the number of points in line protocol contents.
+func countLines(contents []byte) int {
+	return bytes.Count(contents, []byte("\n"))
+}
+
+// withoutInternalMetrics removes the lines of the internal metrics written on
+// every flush from the received contents.
+func withoutInternalMetrics(contents []byte) string {
+	var lines []string
+	for _, line := range strings.SplitAfter(string(contents), "\n") {
+		measurement := line
+		if n := strings.IndexAny(line, ", "); n >= 0 {
+			measurement = line[:n]
+		}
+		internal := false
+		for _, name := range internalMetrics {
+			if strings.HasSuffix(measurement, name) {
+				internal = true
+			}
+		}
+		if !internal {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "")
+}
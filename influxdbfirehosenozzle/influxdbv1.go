@@ -0,0 +1,106 @@
+package influxdbfirehosenozzle
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	influxdbclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// v1Client writes batches to the /write endpoint of InfluxDB 1.x itself,
+// compressed if enabled, so failed writes return a writeError with the status
+// code. Everything else is done by the embedded client.
+type v1Client struct {
+	influxdbclient.Client
+	url        url.URL
+	user       string
+	password   string
+	userAgent  string
+	httpClient *http.Client
+	gzip       *gzipEncoder
+}
+
+func newV1Client(c influxdbclient.Client, addr, user, password, userAgent string, insecureSkipVerify bool, encoder *gzipEncoder) (influxdbclient.Client, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &v1Client{
+		Client:    c,
+		url:       *u,
+		user:      user,
+		password:  password,
+		userAgent: userAgent,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+			},
+		},
+		gzip: encoder,
+	}, nil
+}
+
+func (c *v1Client) Write(bp influxdbclient.BatchPoints) error {
+	var b bytes.Buffer
+	for _, p := range bp.Points() {
+		b.WriteString(p.PrecisionString(bp.Precision()))
+		b.WriteByte('\n')
+	}
+
+	u := c.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+	params := url.Values{}
+	params.Set("db", bp.Database())
+	params.Set("rp", bp.RetentionPolicy())
+	params.Set("precision", bp.Precision())
+	params.Set("consistency", bp.WriteConsistency())
+	u.RawQuery = params.Encode()
+
+	return c.gzip.write(b.Bytes(), func(body io.Reader, compressed bool) error {
+		req, err := http.NewRequest("POST", u.String(), body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "")
+		req.Header.Set("User-Agent", c.userAgent)
+		if compressed {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+		}
+		return doWrite(c.httpClient, req)
+	})
+}
+
+// Close releases the idle connections of both clients.
+func (c *v1Client) Close() error {
+	if t, ok := c.httpClient.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+	return c.Client.Close()
+}
+
+// doWrite sends a write request and returns a writeError if InfluxDB
+// rejected it.
+func doWrite(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return &writeError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package influxdbfirehosenozzle
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	influxdbclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// Supported values of InfluxDbVersion.
+const (
+	influxDbVersion1 = "1"
+	influxDbVersion2 = "2"
+)
+
+// writeError is returned for write requests answered with an error status.
+type writeError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *writeError) Error() string {
+	return e.Body
+}
+
+// v2Client writes to the /api/v2/write endpoint of InfluxDB 2.x and
+// InfluxDB Cloud. It implements the client interface of the 1.x client, the
+// database of a batch is used as bucket.
+type v2Client struct {
+	url        url.URL
+	org        string
+	token      string
+	userAgent  string
+	httpClient *http.Client
+	gzip       *gzipEncoder
+}
+
+func newV2Client(addr, org, token, userAgent string, insecureSkipVerify bool) (*v2Client, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported protocol scheme: %s, your address must start with http:// or https://", u.Scheme)
+	}
+	if org == "" {
+		return nil, errors.New("InfluxDbOrg is required for InfluxDB 2.x")
+	}
+
+	return &v2Client{
+		url:       *u,
+		org:       org,
+		token:     token,
+		userAgent: userAgent,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+			},
+		},
+	}, nil
+}
+
+// Ping checks the health endpoint of InfluxDB.
+func (c *v2Client) Ping(timeout time.Duration) (time.Duration, string, error) {
+	now := time.Now()
+	u := c.url
+	u.Path = "/health"
+	client := *c.httpClient
+	client.Timeout = timeout
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return 0, "", &writeError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return time.Since(now), resp.Header.Get("X-Influxdb-Version"), nil
+}
+
+// Write writes a batch to the bucket named after the database of the batch.
+func (c *v2Client) Write(bp influxdbclient.BatchPoints) error {
+	var b bytes.Buffer
+	for _, p := range bp.Points() {
+		b.WriteString(p.PrecisionString(bp.Precision()))
+		b.WriteByte('\n')
+	}
+
+	u := c.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	params := url.Values{}
+	params.Set("org", c.org)
+	params.Set("bucket", bp.Database())
+	params.Set("precision", v2Precision(bp.Precision()))
+	u.RawQuery = params.Encode()
+
+	return c.gzip.write(b.Bytes(), func(body io.Reader, compressed bool) error {
+		req, err := http.NewRequest("POST", u.String(), body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		req.Header.Set("User-Agent", c.userAgent)
+		if compressed {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Token "+c.token)
+		}
+		return doWrite(c.httpClient, req)
+	})
+}
+
+// Query is not supported by the v2 client.
+func (c *v2Client) Query(q influxdbclient.Query) (*influxdbclient.Response, error) {
+	return nil, errors.New("Queries are not supported for InfluxDB 2.x")
+}
+
+// Close releases the idle connections of the client.
+func (c *v2Client) Close() error {
+	if t, ok := c.httpClient.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
+
+// v2Precision translates the precision of a batch to the precision
+// parameter of the v2 write API.
+func v2Precision(precision string) string {
+	switch precision {
+	case "u", "us":
+		return "us"
+	case "ms":
+		return "ms"
+	case "s":
+		return "s"
+	default:
+		return "ns"
+	}
+}
@@ -0,0 +1,84 @@
+package influxdbfirehosenozzle
+
+import (
+	"sync/atomic"
+	"time"
+
+	influxdbclient "github.com/influxdata/influxdb/client/v2"
+)
+
+// nozzleStats are the totals reported as internal metrics. They are updated
+// by the writers as well, so they are only accessed atomically.
+type nozzleStats struct {
+	messagesReceived uint64
+	pointsWritten    uint64
+	pointsDropped    uint64
+	writeErrors      uint64
+	reconnects       uint64
+	batchSize        uint64
+	flushes          uint64
+	lastWriteFlush   uint64
+}
+
+// flush tracks the batches handed over to the writers by one flush. Its
+// latency is the time from the start of the flush until the last of its
+// batches was written.
+type flush struct {
+	start   time.Time
+	pending int32
+}
+
+// queuedBatch is a batch in the write queue. Batches flushed early because
+// they are full don't belong to a flush.
+type queuedBatch struct {
+	points influxdbclient.BatchPoints
+	flush  *flush
+}
+
+// finishFlushBatch records the latency of a flush once its last batch was
+// written.
+func (i *InfluxdbFirehoseNozzle) finishFlushBatch(f *flush) {
+	if f == nil || atomic.AddInt32(&f.pending, -1) > 0 {
+		return
+	}
+	latency := time.Since(f.start)
+	i.writeLock.Lock()
+	i.flushLatency = latency
+	i.writeLock.Unlock()
+}
+
+func (i *InfluxdbFirehoseNozzle) countDroppedPoints(n int) {
+	atomic.AddUint64(&i.stats.pointsDropped, uint64(n))
+}
+
+// addNozzleMetrics adds the totals of the nozzle, the number of points in
+// the current flush, the latency of the last completed flush and the slow
+// consumer alert. It is called once all points of the flush except the
+// internal metrics were added, the points of batches flushed early since
+// the last flush are part of the flush as well.
+func (i *InfluxdbFirehoseNozzle) addNozzleMetrics() {
+	i.writeLock.Lock()
+	flushLatency := i.flushLatency
+	i.writeLock.Unlock()
+
+	batchSize := uint64(i.pendingPoints() + i.earlyFlushedPoints)
+	atomic.StoreUint64(&i.stats.batchSize, batchSize)
+	i.addInternalMetric("totalMessagesReceived", atomic.LoadUint64(&i.stats.messagesReceived))
+	i.addInternalMetric("totalPointsWritten", atomic.LoadUint64(&i.stats.pointsWritten))
+	i.addInternalMetric("totalPointsDropped", atomic.LoadUint64(&i.stats.pointsDropped))
+	i.addInternalMetric("totalWriteErrors", atomic.LoadUint64(&i.stats.writeErrors))
+	i.addInternalMetric("totalReconnects", atomic.LoadUint64(&i.stats.reconnects))
+	i.addInternalMetric("batchSize", batchSize)
+	i.addInternalMetric("flushLatencyMs", uint64(flushLatency/time.Millisecond))
+
+	i.addInternalMetric("slowConsumerAlert", i.slowConsumerAlert())
+}
+
+// internalMetricName prepends InternalMetricsPrefix, or MetricPrefix if it
+// isn't set, to the name of an internal metric.
+func (i *InfluxdbFirehoseNozzle) internalMetricName(name string) string {
+	if i.config.InternalMetricsPrefix != "" {
+		return i.joinPrefix(i.config.InternalMetricsPrefix, name)
+	}
+	return i.prefixName(name)
+}
@@ -0,0 +1,79 @@
+package influxdbfirehosenozzle
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+const (
+	defaultLogMessagesMeasurement = "logs"
+	defaultLogMessageMaxBytes     = 4096
+)
+
+// addLogMessage adds a log line to the batch, truncating it to the configured
+// size. Log lines exceeding the per flush limit are dropped.
+func (i *InfluxdbFirehoseNozzle) addLogMessage(envelope *events.Envelope) error {
+	if i.config.LogMessagesMaxPerFlush > 0 && i.logMessagesInFlush >= uint64(i.config.LogMessagesMaxPerFlush) {
+		i.logMessagesDropped++
+		i.countDroppedPoints(1)
+		return nil
+	}
+
+	logMessage := envelope.GetLogMessage()
+	message, truncated := truncateMessage(logMessage.GetMessage(), i.logMessageMaxBytes())
+
+	tags := map[string]string{
+		"deployment":      envelope.GetDeployment(),
+		"job":             envelope.GetJob(),
+		"index":           envelope.GetIndex(),
+		"ip":              envelope.GetIp(),
+		"source_type":     logMessage.GetSourceType(),
+		"source_instance": logMessage.GetSourceInstance(),
+		"app_id":          logMessage.GetAppId(),
+		"message_type":    logMessage.GetMessageType().String(),
+	}
+	i.applyRelabeling(envelope, tags)
+
+	fields := map[string]interface{}{
+		"message": message,
+	}
+	if truncated {
+		fields["truncated"] = true
+	}
+
+	err := i.addPoint(i.route(envelope, tags), i.logMessagesMeasurement(), tags, fields, time.Unix(0, logMessage.GetTimestamp()))
+	if err != nil {
+		return err
+	}
+	i.logMessagesInFlush++
+	return nil
+}
+
+func (i *InfluxdbFirehoseNozzle) logMessagesMeasurement() string {
+	if i.config.LogMessagesMeasurement == "" {
+		return defaultLogMessagesMeasurement
+	}
+	return i.config.LogMessagesMeasurement
+}
+
+func (i *InfluxdbFirehoseNozzle) logMessageMaxBytes() int {
+	if i.config.LogMessageMaxBytes == 0 {
+		return defaultLogMessageMaxBytes
+	}
+	return int(i.config.LogMessageMaxBytes)
+}
+
+// truncateMessage cuts a message to at most maxBytes without splitting a
+// multi-byte character.
+func truncateMessage(message []byte, maxBytes int) (string, bool) {
+	if len(message) <= maxBytes {
+		return string(message), false
+	}
+	n := maxBytes
+	for n > 0 && !utf8.RuneStart(message[n]) {
+		n--
+	}
+	return string(message[:n]), true
+}
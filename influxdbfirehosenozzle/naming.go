@@ -0,0 +1,78 @@
+package influxdbfirehosenozzle
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// templateReplacer replaces the envelope values which can be referenced in
+// measurement and tag templates as {origin}, {name}, {event_type},
+// {deployment} and {job}. All placeholders are replaced in a single pass, so
+// placeholders within the values are kept as they are.
+func templateReplacer(envelope *events.Envelope) *strings.Replacer {
+	return strings.NewReplacer(
+		"{origin}", envelope.GetOrigin(),
+		"{name}", metricName(envelope),
+		"{event_type}", envelope.GetEventType().String(),
+		"{deployment}", envelope.GetDeployment(),
+		"{job}", envelope.GetJob(),
+	)
+}
+
+// metricName returns the metric name of value metrics and counter events and
+// the event type for all other events.
+func metricName(envelope *events.Envelope) string {
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric:
+		return envelope.GetValueMetric().GetName()
+	case events.Envelope_CounterEvent:
+		return envelope.GetCounterEvent().GetName()
+	default:
+		return envelope.GetEventType().String()
+	}
+}
+
+// measurementName generates the measurement name from the configured
+// template, falling back to GetName if no template is set.
+func (i *InfluxdbFirehoseNozzle) measurementName(envelope *events.Envelope) (string, error) {
+	if i.config.MeasurementTemplate == "" {
+		return GetName(envelope)
+	}
+	name := templateReplacer(envelope).Replace(i.config.MeasurementTemplate)
+	if name == "" {
+		return "", fmt.Errorf("Measurement template %s expands to an empty name", i.config.MeasurementTemplate)
+	}
+	return name, nil
+}
+
+// addTemplateTags adds the tags defined by the configured tag templates.
+func (i *InfluxdbFirehoseNozzle) addTemplateTags(envelope *events.Envelope, tags map[string]string) {
+	if len(i.config.TagTemplates) == 0 {
+		return
+	}
+	r := templateReplacer(envelope)
+	for k, template := range i.config.TagTemplates {
+		tags[k] = r.Replace(template)
+	}
+}
+
+// tagsKey serializes tags in a stable order so they can be used as map key.
+func tagsKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b []byte
+	for _, k := range keys {
+		b = append(b, k...)
+		b = append(b, '=')
+		b = append(b, tags[k]...)
+		b = append(b, ',')
+	}
+	return string(b)
+}
@@ -0,0 +1,159 @@
+package influxdbfirehosenozzle
+
+import (
+	"fmt"
+	"strings"
+
+	influxdbclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/joek/influxdb-firehose-nozzle/nozzleconfig"
+)
+
+// createDatabases creates the databases points are written to and the
+// configured retention policies on every InfluxDB server if they don't
+// exist yet. Existing databases and retention policies are left alone.
+func (i *InfluxdbFirehoseNozzle) createDatabases() error {
+	if i.config.InfluxDbUDPAddress != "" || i.config.InfluxDbVersion == influxDbVersion2 {
+		i.Log.Warn("CreateDatabase is only supported for the HTTP API of InfluxDB 1.x, skipping")
+		return nil
+	}
+	for n, rp := range i.config.RetentionPolicies {
+		if rp.Name == "" {
+			return fmt.Errorf("Invalid retention policy %d: name is required", n)
+		}
+	}
+
+	if len(i.endpoints) == 0 {
+		return i.provision(i.config.InfluxDbURL, i.Client)
+	}
+	for _, e := range i.endpoints {
+		err := i.provision(e.url, e.client)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// databases returns the default database followed by the databases of the
+// routing rules.
+func (i *InfluxdbFirehoseNozzle) databases() []string {
+	databases := []string{i.database()}
+	seen := map[string]bool{i.database(): true}
+	for _, r := range i.routingRules {
+		if r.route.database != "" && !seen[r.route.database] {
+			seen[r.route.database] = true
+			databases = append(databases, r.route.database)
+		}
+	}
+	return databases
+}
+
+func (i *InfluxdbFirehoseNozzle) provision(url string, c influxdbclient.Client) error {
+	existing, err := queryNames(c, "SHOW DATABASES", "")
+	if err != nil {
+		return fmt.Errorf("Listing databases on %s failed: %v", url, err)
+	}
+
+	for _, db := range i.databases() {
+		if !existing[db] {
+			_, err = queryNames(c, "CREATE DATABASE "+quoteIdent(db), "")
+			if err != nil {
+				return fmt.Errorf("Creating database %s on %s failed: %v", db, url, err)
+			}
+			i.Log.Infof("Created database %s on %s", db, url)
+		}
+		if len(i.config.RetentionPolicies) == 0 {
+			continue
+		}
+
+		policies, err := queryNames(c, "SHOW RETENTION POLICIES ON "+quoteIdent(db), db)
+		if err != nil {
+			return fmt.Errorf("Listing retention policies of database %s on %s failed: %v", db, url, err)
+		}
+		for _, rp := range i.config.RetentionPolicies {
+			if policies[rp.Name] {
+				continue
+			}
+			_, err = queryNames(c, createRetentionPolicy(db, rp), db)
+			if err != nil {
+				return fmt.Errorf("Creating retention policy %s of database %s on %s failed: %v", rp.Name, db, url, err)
+			}
+			i.Log.Infof("Created retention policy %s of database %s on %s: %s", rp.Name, db, url, describeRetentionPolicy(rp))
+		}
+	}
+	return nil
+}
+
+// queryNames runs a query and returns the values of the name column.
+func queryNames(c influxdbclient.Client, command, database string) (map[string]bool, error) {
+	resp, err := c.Query(influxdbclient.Query{Command: command, Database: database})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+
+	names := map[string]bool{}
+	for _, result := range resp.Results {
+		for _, row := range result.Series {
+			column := -1
+			for n, name := range row.Columns {
+				if name == "name" {
+					column = n
+				}
+			}
+			if column < 0 {
+				continue
+			}
+			for _, values := range row.Values {
+				if name, ok := values[column].(string); ok {
+					names[name] = true
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+func createRetentionPolicy(db string, rp nozzleconfig.RetentionPolicy) string {
+	duration, replication := retentionPolicyDefaults(rp)
+	command := fmt.Sprintf("CREATE RETENTION POLICY %s ON %s DURATION %s REPLICATION %d",
+		quoteIdent(rp.Name), quoteIdent(db), duration, replication)
+	if rp.ShardGroupDuration != "" {
+		command += " SHARD DURATION " + rp.ShardGroupDuration
+	}
+	if rp.Default {
+		command += " DEFAULT"
+	}
+	return command
+}
+
+func describeRetentionPolicy(rp nozzleconfig.RetentionPolicy) string {
+	duration, replication := retentionPolicyDefaults(rp)
+	description := fmt.Sprintf("duration %s, replication %d", duration, replication)
+	if rp.ShardGroupDuration != "" {
+		description += ", shard group duration " + rp.ShardGroupDuration
+	}
+	if rp.Default {
+		description += ", default"
+	}
+	return description
+}
+
+func retentionPolicyDefaults(rp nozzleconfig.RetentionPolicy) (string, uint32) {
+	duration := rp.Duration
+	if duration == "" {
+		duration = "INF"
+	}
+	replication := rp.Replication
+	if replication == 0 {
+		replication = 1
+	}
+	return duration, replication
+}
+
+// quoteIdent quotes an InfluxQL identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
@@ -0,0 +1,336 @@
+package influxdbfirehosenozzle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	influxdbclient "github.com/influxdata/influxdb/client/v2"
+)
+
+const (
+	defaultDeadLetterMaxMegabytes = 100
+
+	// maxRejectedWrites bounds how often the rest of a batch is resent
+	// after InfluxDB rejected some of its points.
+	maxRejectedWrites = 10
+	// maxLoggedRejectedPoints bounds the number of rejected points logged
+	// per write if no dead-letter file is configured.
+	maxLoggedRejectedPoints = 10
+)
+
+// Reasons of rejected points.
+const (
+	rejectFieldTypeConflict = "field_type_conflict"
+	rejectUnableToParse     = "unable_to_parse"
+	rejectMaxValuesPerTag   = "max_values_per_tag"
+	rejectMaxSeries         = "max_series_per_database"
+	rejectBeyondRetention   = "beyond_retention_policy"
+	rejectEntityTooLarge    = "entity_too_large"
+)
+
+var (
+	fieldTypeConflictError = regexp.MustCompile(`field type conflict: input field "(.+?)" on measurement "(.+?)" is type`)
+	unableToParseError     = regexp.MustCompile(`unable to parse '(.*?)': `)
+	maxValuesPerTagError   = regexp.MustCompile(`max-values-per-tag limit exceeded \(\d+/\d+\): measurement="(.+?)" tag="(.+?)" value="(.+?)"`)
+	partialWriteDropped    = regexp.MustCompile(`dropped=(\d+)`)
+)
+
+// rejection describes the points of a batch InfluxDB rejected. If match is
+// nil, the offending points can't be told apart. If InfluxDB reported the
+// number of points it dropped from a partial write, the rest of the batch
+// was written. A batch which is too large is split.
+type rejection struct {
+	reason   string
+	match    func(pt *influxdbclient.Point, line string) bool
+	dropped  int
+	tooLarge bool
+}
+
+// parseRejection parses the error of a write answered with a client error.
+// InfluxDB 1.x names the first field type conflict or tag value exceeding
+// max-values-per-tag, and every line it was unable to parse. For series
+// exceeding max-series-per-database and points beyond the retention policy,
+// it only reports the number of dropped points.
+func parseRejection(err error) rejection {
+	if e, ok := err.(*writeError); ok && e.StatusCode == http.StatusRequestEntityTooLarge {
+		return rejection{reason: rejectEntityTooLarge, tooLarge: true}
+	}
+	msg := errorMessage(err.Error())
+
+	if m := fieldTypeConflictError.FindStringSubmatch(msg); m != nil {
+		field, measurement := m[1], m[2]
+		return rejection{
+			reason: rejectFieldTypeConflict,
+			match: func(pt *influxdbclient.Point, line string) bool {
+				if pt.Name() != measurement {
+					return false
+				}
+				_, ok := pt.Fields()[field]
+				return ok
+			},
+		}
+	}
+
+	if m := unableToParseError.FindAllStringSubmatch(msg, -1); m != nil {
+		lines := map[string]bool{}
+		for _, l := range m {
+			lines[l[1]] = true
+		}
+		return rejection{
+			reason: rejectUnableToParse,
+			match: func(pt *influxdbclient.Point, line string) bool {
+				return lines[line]
+			},
+		}
+	}
+
+	if m := maxValuesPerTagError.FindStringSubmatch(msg); m != nil {
+		measurement, tag, value := m[1], m[2], m[3]
+		return rejection{
+			reason: rejectMaxValuesPerTag,
+			match: func(pt *influxdbclient.Point, line string) bool {
+				return pt.Name() == measurement && pt.Tags()[tag] == value
+			},
+		}
+	}
+
+	switch {
+	case strings.Contains(msg, "max-series-per-database limit exceeded"):
+		return rejection{reason: rejectMaxSeries, dropped: droppedPoints(msg)}
+	case strings.Contains(msg, "points beyond retention policy"):
+		return rejection{reason: rejectBeyondRetention, dropped: droppedPoints(msg)}
+	default:
+		return rejection{}
+	}
+}
+
+// droppedPoints returns the number of points InfluxDB dropped from a partial
+// write, or 0 if the message doesn't report it.
+func droppedPoints(msg string) int {
+	m := partialWriteDropped.FindStringSubmatch(msg)
+	if m == nil {
+		return 0
+	}
+	dropped, _ := strconv.Atoi(m[1])
+	return dropped
+}
+
+// errorMessage extracts the message of the JSON error body of InfluxDB 1.x
+// and 2.x.
+func errorMessage(body string) string {
+	var e struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal([]byte(body), &e) != nil {
+		return body
+	}
+	if e.Error != "" {
+		return e.Error
+	}
+	if e.Message != "" {
+		return e.Message
+	}
+	return body
+}
+
+// handleRejectedWrite quarantines the points of a batch InfluxDB rejected
+// and resends the rest using write. Resending points which InfluxDB already
+// wrote as part of a partial write doesn't duplicate them, as points with
+// the same series and timestamp overwrite each other. Only points named by
+// the error are quarantined. It returns the points which are still pending
+// with the error if a resend failed or the error doesn't name the offending
+// points.
+func (i *InfluxdbFirehoseNozzle) handleRejectedWrite(bp influxdbclient.BatchPoints, err error, write func(influxdbclient.BatchPoints) error) (influxdbclient.BatchPoints, error) {
+	for n := 0; n < maxRejectedWrites; n++ {
+		r := parseRejection(err)
+		if r.tooLarge {
+			return i.splitRejectedWrite(bp, err, write)
+		}
+		if r.match == nil && r.dropped > 0 && r.dropped <= len(bp.Points()) {
+			i.countPartialWrite(bp, r, err)
+			return i.newBatchPoints(destinationOf(bp)), nil
+		}
+		if r.match == nil {
+			break
+		}
+
+		rest := i.newBatchPoints(destinationOf(bp))
+		var rejected []*influxdbclient.Point
+		for _, pt := range bp.Points() {
+			if r.match(pt, pt.PrecisionString(bp.Precision())) {
+				rejected = append(rejected, pt)
+			} else {
+				rest.AddPoint(pt)
+			}
+		}
+		if len(rejected) == 0 {
+			break
+		}
+
+		i.quarantine(bp, rejected, r.reason, err)
+		if len(rest.Points()) == 0 {
+			return rest, nil
+		}
+		bp = rest
+		err = write(bp)
+		if err == nil || isRetryableWriteError(err) {
+			return bp, err
+		}
+	}
+
+	return bp, err
+}
+
+// splitRejectedWrite writes the halves of a batch InfluxDB rejected as too
+// large. A single point which is too large is quarantined. If writing a half
+// fails, it returns the points of that and the following half.
+func (i *InfluxdbFirehoseNozzle) splitRejectedWrite(bp influxdbclient.BatchPoints, err error, write func(influxdbclient.BatchPoints) error) (influxdbclient.BatchPoints, error) {
+	points := bp.Points()
+	pending := i.newBatchPoints(destinationOf(bp))
+	if len(points) == 1 {
+		i.quarantine(bp, points, rejectEntityTooLarge, err)
+		return pending, nil
+	}
+
+	var pendingErr error
+	for _, half := range [][]*influxdbclient.Point{points[:len(points)/2], points[len(points)/2:]} {
+		if pendingErr != nil {
+			pending.AddPoints(half)
+			continue
+		}
+		b := i.newBatchPoints(destinationOf(bp))
+		b.AddPoints(half)
+		err := write(b)
+		if err != nil && !isRetryableWriteError(err) {
+			b, err = i.handleRejectedWrite(b, err, write)
+		}
+		if err != nil {
+			pending.AddPoints(b.Points())
+			pendingErr = err
+		}
+	}
+	return pending, pendingErr
+}
+
+// countPartialWrite counts the points InfluxDB dropped from a partial write
+// which doesn't name them, and the rest of the batch as written. The batch
+// is not resent, as it can't be told which points were dropped.
+func (i *InfluxdbFirehoseNozzle) countPartialWrite(bp influxdbclient.BatchPoints, r rejection, err error) {
+	i.writeLock.Lock()
+	i.rejectedPoints[r.reason] += uint64(r.dropped)
+	i.writeLock.Unlock()
+	i.countDroppedPoints(r.dropped)
+	i.countWrittenPoints(len(bp.Points()) - r.dropped)
+	i.Log.Errorf("InfluxDB dropped %d of %d points (%s): %v", r.dropped, len(bp.Points()), r.reason, err)
+}
+
+// quarantine counts rejected points by reason and writes them to the
+// dead-letter file, or logs them if there is none.
+func (i *InfluxdbFirehoseNozzle) quarantine(bp influxdbclient.BatchPoints, points []*influxdbclient.Point, reason string, err error) {
+	i.writeLock.Lock()
+	i.rejectedPoints[reason] += uint64(len(points))
+	i.writeLock.Unlock()
+	i.countDroppedPoints(len(points))
+
+	lines := make([]string, len(points))
+	for n, pt := range points {
+		lines[n] = pt.PrecisionString(bp.Precision())
+	}
+
+	if i.deadLetter != nil {
+		writeErr := i.deadLetter.write(bp, lines, reason, err)
+		if writeErr == nil {
+			i.Log.Errorf("Quarantined %d points rejected by InfluxDB (%s) to %s: %v", len(points), reason, i.deadLetter.path, err)
+			return
+		}
+		i.Log.Errorf("Writing to dead-letter file failed: %v", writeErr)
+	}
+
+	i.Log.Errorf("Dropping %d points rejected by InfluxDB (%s): %v", len(points), reason, err)
+	for n, line := range lines {
+		if n == maxLoggedRejectedPoints {
+			i.Log.Warnf("%d more rejected points not logged", len(lines)-n)
+			break
+		}
+		i.Log.Warnf("Rejected point: %s", line)
+	}
+}
+
+// addRejectionMetrics adds the number of points rejected since the last
+// flush by reason.
+func (i *InfluxdbFirehoseNozzle) addRejectionMetrics() {
+	i.writeLock.Lock()
+	rejected := i.rejectedPoints
+	i.rejectedPoints = make(map[string]uint64)
+	i.writeLock.Unlock()
+
+	for reason, count := range rejected {
+		i.addInternalMetricWithTags("rejectedPoints", count, map[string]string{"reason": reason})
+	}
+}
+
+// deadLetterFile stores rejected points as line protocol. Every write starts
+// with a comment header naming the destination, the reason and the error,
+// so the points can be fixed and written again. Once the file exceeds its
+// maximum size, it is moved to a backup file ending in .1, replacing the
+// previous backup.
+type deadLetterFile struct {
+	path     string
+	maxBytes int64
+	lock     sync.Mutex
+}
+
+func newDeadLetterFile(path string, maxMegabytes uint32) *deadLetterFile {
+	if maxMegabytes == 0 {
+		maxMegabytes = defaultDeadLetterMaxMegabytes
+	}
+	return &deadLetterFile{path: path, maxBytes: int64(maxMegabytes) * 1024 * 1024}
+}
+
+func (f *deadLetterFile) write(bp influxdbclient.BatchPoints, lines []string, reason string, err error) error {
+	header := url.Values{}
+	header.Set("time", time.Now().UTC().Format(time.RFC3339))
+	header.Set("database", bp.Database())
+	header.Set("retention_policy", bp.RetentionPolicy())
+	header.Set("precision", bp.Precision())
+	header.Set("reason", reason)
+	header.Set("error", errorMessage(err.Error()))
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n", header.Encode())
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if info, statErr := os.Stat(f.path); statErr == nil && info.Size() > 0 && info.Size()+int64(b.Len()) > f.maxBytes {
+		renameErr := os.Rename(f.path, f.path+".1")
+		if renameErr != nil {
+			return renameErr
+		}
+	}
+
+	file, openErr := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if openErr != nil {
+		return openErr
+	}
+	_, writeErr := file.Write(b.Bytes())
+	closeErr := file.Close()
+	if writeErr != nil {
+		return writeErr
+	}
+	return closeErr
+}
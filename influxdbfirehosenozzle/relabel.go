@@ -0,0 +1,146 @@
+package influxdbfirehosenozzle
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/joek/influxdb-firehose-nozzle/nozzleconfig"
+)
+
+const (
+	defaultRelabelRegex       = "(.*)"
+	defaultRelabelReplacement = "$1"
+	relabelSourceSeparator    = ";"
+)
+
+type relabelRule struct {
+	action      string
+	sourceTags  []string
+	regex       *regexp.Regexp
+	targetTag   string
+	replacement string
+	tags        map[string]string
+}
+
+type relabeler struct {
+	rules []relabelRule
+}
+
+func newRelabeler(rules []nozzleconfig.RelabelRule) (*relabeler, error) {
+	r := &relabeler{}
+	for n, rule := range rules {
+		regex := rule.Regex
+		if regex == "" {
+			regex = defaultRelabelRegex
+		}
+		re, err := regexp.Compile("^(?:" + regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid relabel rule %d: %s", n, err)
+		}
+
+		replacement := rule.Replacement
+		if replacement == "" {
+			replacement = defaultRelabelReplacement
+		}
+
+		action := rule.Action
+		switch action {
+		case "":
+			action = nozzleconfig.RelabelReplace
+		case nozzleconfig.RelabelReplace, nozzleconfig.RelabelDrop:
+		case nozzleconfig.RelabelRename:
+			if len(rule.SourceTags) != 1 || rule.TargetTag == "" {
+				return nil, fmt.Errorf("Invalid relabel rule %d: rename needs exactly one source tag and a target tag", n)
+			}
+		default:
+			return nil, fmt.Errorf("Invalid relabel rule %d: unknown action %s", n, rule.Action)
+		}
+
+		// A drop rule without regex only drops the listed source tags.
+		if action == nozzleconfig.RelabelDrop && rule.Regex == "" {
+			re = nil
+		}
+
+		r.rules = append(r.rules, relabelRule{
+			action:      action,
+			sourceTags:  rule.SourceTags,
+			regex:       re,
+			targetTag:   rule.TargetTag,
+			replacement: replacement,
+			tags:        rule.Tags,
+		})
+	}
+	return r, nil
+}
+
+// relabel applies all rules in order to the tags of a point. Besides tags,
+// rules can read the metric name as __name__ and the origin as __origin__.
+func (r *relabeler) relabel(envelope *events.Envelope, tags map[string]string) {
+	for _, rule := range r.rules {
+		switch rule.action {
+		case nozzleconfig.RelabelRename:
+			if v, ok := tags[rule.sourceTags[0]]; ok {
+				delete(tags, rule.sourceTags[0])
+				tags[rule.targetTag] = v
+			}
+		case nozzleconfig.RelabelDrop:
+			for _, k := range rule.sourceTags {
+				delete(tags, k)
+			}
+			if rule.regex != nil {
+				for k := range tags {
+					if rule.regex.MatchString(k) {
+						delete(tags, k)
+					}
+				}
+			}
+		default:
+			rule.replace(envelope, tags)
+		}
+	}
+}
+
+func (rule relabelRule) replace(envelope *events.Envelope, tags map[string]string) {
+	values := make([]string, len(rule.sourceTags))
+	for n, k := range rule.sourceTags {
+		values[n] = sourceValue(envelope, tags, k)
+	}
+	value := strings.Join(values, relabelSourceSeparator)
+
+	match := rule.regex.FindStringSubmatchIndex(value)
+	if match == nil {
+		return
+	}
+
+	if rule.targetTag != "" {
+		v := string(rule.regex.ExpandString(nil, rule.replacement, value, match))
+		if v == "" {
+			delete(tags, rule.targetTag)
+		} else {
+			tags[rule.targetTag] = v
+		}
+	}
+	for k, v := range rule.tags {
+		tags[k] = v
+	}
+}
+
+func sourceValue(envelope *events.Envelope, tags map[string]string, key string) string {
+	switch key {
+	case "__name__":
+		return metricName(envelope)
+	case "__origin__":
+		return envelope.GetOrigin()
+	default:
+		return tags[key]
+	}
+}
+
+// applyRelabeling relabels the tags of a point if relabel rules are configured.
+func (i *InfluxdbFirehoseNozzle) applyRelabeling(envelope *events.Envelope, tags map[string]string) {
+	if i.relabeler != nil {
+		i.relabeler.relabel(envelope, tags)
+	}
+}
@@ -0,0 +1,130 @@
+package influxdbfirehosenozzle
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	influxdbclient "github.com/influxdata/influxdb/client/v2"
+)
+
+const (
+	defaultRetryMaxAttempts          = 5
+	defaultRetryInitialBackoffMillis = 500
+	defaultRetryMaxBackoffSeconds    = 30
+	defaultMaxBufferedPoints         = 100000
+)
+
+// isRetryableWriteError returns false for writes InfluxDB answered with a
+// client error caused by the batch itself. Server errors, 429 Too Many
+// Requests, setup errors, network errors and timeouts are retryable.
+func isRetryableWriteError(err error) bool {
+	if e, ok := err.(*writeError); ok {
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || isSetupError(err)
+	}
+	return true
+}
+
+// isSetupError returns true for writes InfluxDB rejected because of its
+// setup: wrong credentials or token, missing permissions or a missing
+// database or bucket. Retrying them right away doesn't help, but the batch
+// is kept until the setup is fixed.
+func isSetupError(err error) bool {
+	e, ok := err.(*writeError)
+	if !ok {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	}
+	return false
+}
+
+// retryBackoff returns the initial and the maximum backoff of retries.
+func (i *InfluxdbFirehoseNozzle) retryBackoff() (time.Duration, time.Duration) {
+	backoff := time.Duration(i.config.RetryInitialBackoffMillis) * time.Millisecond
+	if backoff == 0 {
+		backoff = defaultRetryInitialBackoffMillis * time.Millisecond
+	}
+	maxBackoff := time.Duration(i.config.RetryMaxBackoffSeconds) * time.Second
+	if maxBackoff == 0 {
+		maxBackoff = defaultRetryMaxBackoffSeconds * time.Second
+	}
+	return backoff, maxBackoff
+}
+
+// writeWithRetry writes a batch, retrying retryable errors with exponential
+// backoff and jitter.
+func (i *InfluxdbFirehoseNozzle) writeWithRetry(bp influxdbclient.BatchPoints) error {
+	maxAttempts := int(i.config.RetryMaxAttempts)
+	if maxAttempts == 0 {
+		maxAttempts = defaultRetryMaxAttempts
+	}
+	backoff, maxBackoff := i.retryBackoff()
+
+	for attempt := 1; ; attempt++ {
+		err := i.Client.Write(bp)
+		if err == nil || !isRetryableWriteError(err) || isSetupError(err) || attempt >= maxAttempts {
+			return err
+		}
+
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		i.Log.Warnf("Writing to InfluxDB failed (attempt %d of %d), retrying in %s: %v", attempt, maxAttempts, sleep, err)
+		time.Sleep(sleep)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (i *InfluxdbFirehoseNozzle) maxBufferedPoints() int {
+	if i.config.MaxBufferedPoints == 0 {
+		return defaultMaxBufferedPoints
+	}
+	return int(i.config.MaxBufferedPoints)
+}
+
+// limitBufferedPoints drops the oldest points kept for the next flush once
+// the batches of all destinations together exceed the configured bound.
+// Kept points are at the front of their batch, so the oldest points are
+// found by comparing the first remaining point of each batch.
+func (i *InfluxdbFirehoseNozzle) limitBufferedPoints() {
+	maxPoints := i.maxBufferedPoints()
+	excess := i.pendingPoints() - maxPoints
+	if excess <= 0 {
+		return
+	}
+
+	dropped := make(map[destination]int)
+	for n := 0; n < excess; n++ {
+		var oldest destination
+		var oldestTime time.Time
+		found := false
+		for d, b := range i.batches {
+			points := b.points.Points()
+			if dropped[d] >= len(points) {
+				continue
+			}
+			t := points[dropped[d]].Time()
+			if !found || t.Before(oldestTime) {
+				oldest, oldestTime, found = d, t, true
+			}
+		}
+		dropped[oldest]++
+	}
+	for d, count := range dropped {
+		bp := i.newBatchPoints(d)
+		bp.AddPoints(i.batches[d].points.Points()[count:])
+		if len(bp.Points()) == 0 {
+			delete(i.batches, d)
+			continue
+		}
+		i.batches[d] = i.newBatch(bp)
+	}
+
+	i.countDroppedPoints(excess)
+	i.Log.Errorf("Buffer exceeds %d points, dropping the %d oldest points", maxPoints, excess)
+}
@@ -0,0 +1,62 @@
+package influxdbfirehosenozzle
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/joek/influxdb-firehose-nozzle/nozzleconfig"
+)
+
+// route is the database and retention policy chosen by a routing rule. The
+// zero route writes to the default database.
+type route struct {
+	database        string
+	retentionPolicy string
+}
+
+type routingRule struct {
+	matcher filterMatcher
+	route   route
+}
+
+func newRoutingRules(rules []nozzleconfig.RoutingRule) ([]routingRule, error) {
+	var result []routingRule
+	for n, rule := range rules {
+		m, err := newFilterMatcher(nozzleconfig.FilterRule{
+			Field: rule.Field,
+			Tag:   rule.Tag,
+			Match: rule.Match,
+			Value: rule.Value,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Invalid routing rule %d: %s", n, err)
+		}
+		if rule.Database == "" && rule.RetentionPolicy == "" {
+			return nil, fmt.Errorf("Invalid routing rule %d: database or retention policy required", n)
+		}
+		result = append(result, routingRule{
+			matcher: m,
+			route:   route{database: rule.Database, retentionPolicy: rule.RetentionPolicy},
+		})
+	}
+	return result, nil
+}
+
+// route returns the route of the first rule matching an envelope. Tag rules
+// match the tags of the point, which include the tags derived from the
+// envelope like application_id.
+func (i *InfluxdbFirehoseNozzle) route(envelope *events.Envelope, tags map[string]string) route {
+	for _, r := range i.routingRules {
+		if r.matcher.field == "tag" {
+			v, ok := tags[r.matcher.tag]
+			if ok && r.matcher.match(v) {
+				return r.route
+			}
+			continue
+		}
+		if r.matcher.matches(envelope) {
+			return r.route
+		}
+	}
+	return route{}
+}
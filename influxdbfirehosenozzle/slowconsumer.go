@@ -0,0 +1,43 @@
+package influxdbfirehosenozzle
+
+import (
+	"time"
+
+	noaaerrors "github.com/cloudfoundry/noaa/errors"
+	"github.com/gorilla/websocket"
+)
+
+const defaultSlowConsumerResetSeconds = 60
+
+// isPolicyViolation returns true if the traffic controller closed the
+// websocket with status 1008 because the nozzle didn't keep up.
+func isPolicyViolation(err error) bool {
+	if retryErr, ok := err.(noaaerrors.RetryError); ok {
+		err = retryErr.Err
+	}
+	closeErr, ok := err.(*websocket.CloseError)
+	return ok && closeErr.Code == websocket.ClosePolicyViolation
+}
+
+func (i *InfluxdbFirehoseNozzle) alertSlowConsumerError() {
+	i.slowConsumerAlertedAt = time.Now()
+}
+
+// slowConsumerAlert returns 1 until no slow consumer was detected for
+// SlowConsumerResetSeconds.
+func (i *InfluxdbFirehoseNozzle) slowConsumerAlert() uint64 {
+	if i.slowConsumerAlertedAt.IsZero() {
+		return 0
+	}
+
+	reset := time.Duration(i.config.SlowConsumerResetSeconds) * time.Second
+	if reset == 0 {
+		reset = defaultSlowConsumerResetSeconds * time.Second
+	}
+	if time.Since(i.slowConsumerAlertedAt) < reset {
+		return 1
+	}
+	i.Log.Infof("No slow consumer detected for %s, resetting slowConsumerAlert", reset)
+	i.slowConsumerAlertedAt = time.Time{}
+	return 0
+}
@@ -0,0 +1,332 @@
+package influxdbfirehosenozzle
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/gosteno"
+	influxdbclient "github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	defaultSpoolMaxMegabytes = 1024
+
+	spoolIndexFile     = "index"
+	spoolSegmentSuffix = ".lp"
+)
+
+// spool is a write-ahead buffer on disk for batches which could not be
+// written to InfluxDB. Every batch is stored as a line protocol segment file
+// named after its sequence number. The index file holds the sequence numbers
+// of the oldest pending and the next segment, so replay continues where it
+// stopped after a restart.
+type spool struct {
+	dir      string
+	maxBytes int64
+	log      *gosteno.Logger
+	head     uint64
+	next     uint64
+	segments []spoolSegment
+	size     int64
+}
+
+type spoolSegment struct {
+	seq  uint64
+	size int64
+}
+
+func newSpool(dir string, maxMegabytes uint32, log *gosteno.Logger) (*spool, error) {
+	if maxMegabytes == 0 {
+		maxMegabytes = defaultSpoolMaxMegabytes
+	}
+	s := &spool{
+		dir:      dir,
+		maxBytes: int64(maxMegabytes) * 1024 * 1024,
+		log:      log,
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Can not create spool directory %s: %s", dir, err)
+	}
+	err = s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	err = s.scanSegments()
+	if err != nil {
+		return nil, err
+	}
+	return s, s.writeIndex()
+}
+
+// readIndex loads the sequence numbers of the index file. A missing index
+// means an empty spool.
+func (s *spool) readIndex() error {
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, spoolIndexFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Can not read spool index: %s", err)
+	}
+	_, err = fmt.Sscanf(string(content), "%d %d", &s.head, &s.next)
+	if err != nil {
+		return fmt.Errorf("Can not parse spool index: %s", err)
+	}
+	return nil
+}
+
+// scanSegments reconciles the index with the segment files on disk.
+// Segments before the head were replayed but not yet removed, segments at or
+// after next were written but not yet recorded in the index.
+func (s *spool) scanSegments() error {
+	// ReadDir sorts by name and segment names are zero padded, so segments
+	// are in sequence order.
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("Can not read spool directory %s: %s", s.dir, err)
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq < s.head {
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+		s.segments = append(s.segments, spoolSegment{seq: seq, size: f.Size()})
+		s.size += f.Size()
+	}
+	return nil
+}
+
+// writeIndex atomically replaces the index file.
+func (s *spool) writeIndex() error {
+	if len(s.segments) > 0 {
+		s.head = s.segments[0].seq
+	} else {
+		s.head = s.next
+	}
+	return s.writeFile(spoolIndexFile, []byte(fmt.Sprintf("%d %d\n", s.head, s.next)))
+}
+
+func (s *spool) writeFile(name string, content []byte) error {
+	tmp := filepath.Join(s.dir, name+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, name))
+}
+
+func (s *spool) segmentFile(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, spoolSegmentSuffix)
+}
+
+// len returns the number of pending segments.
+func (s *spool) len() int {
+	return len(s.segments)
+}
+
+// append stores a batch as new segment, evicting the oldest segments if the
+// spool would exceed its size cap.
+func (s *spool) append(bp influxdbclient.BatchPoints) error {
+	b := encodeSegment(bp)
+	size := int64(b.Len())
+	if size > s.maxBytes {
+		return fmt.Errorf("Batch of %d bytes exceeds the spool size of %d bytes", size, s.maxBytes)
+	}
+	for s.size+size > s.maxBytes {
+		oldest := s.segments[0]
+		s.log.Warnf("Spool exceeds %d bytes, dropping the oldest segment %s", s.maxBytes, s.segmentFile(oldest.seq))
+		err := s.removeOldest()
+		if err != nil {
+			return err
+		}
+	}
+
+	seq := s.next
+	err := s.writeFile(s.segmentFile(seq), b.Bytes())
+	if err != nil {
+		return err
+	}
+	s.next++
+	s.segments = append(s.segments, spoolSegment{seq: seq, size: size})
+	s.size += size
+	return s.writeIndex()
+}
+
+// replaceOldest replaces the oldest segment with the points of a batch
+// which are still pending.
+func (s *spool) replaceOldest(bp influxdbclient.BatchPoints) error {
+	b := encodeSegment(bp)
+	oldest := &s.segments[0]
+	err := s.writeFile(s.segmentFile(oldest.seq), b.Bytes())
+	if err != nil {
+		return err
+	}
+	s.size += int64(b.Len()) - oldest.size
+	oldest.size = int64(b.Len())
+	return nil
+}
+
+// encodeSegment encodes a batch as line protocol, preceded by a comment
+// header with its destination and write parameters.
+func encodeSegment(bp influxdbclient.BatchPoints) *bytes.Buffer {
+	var b bytes.Buffer
+	header := url.Values{}
+	header.Set("database", bp.Database())
+	header.Set("retention_policy", bp.RetentionPolicy())
+	header.Set("precision", bp.Precision())
+	header.Set("consistency", bp.WriteConsistency())
+	fmt.Fprintf(&b, "# %s\n", header.Encode())
+	for _, p := range bp.Points() {
+		b.WriteString(p.String())
+		b.WriteByte('\n')
+	}
+	return &b
+}
+
+// oldest reads the oldest pending segment.
+func (s *spool) oldest() (influxdbclient.BatchPoints, error) {
+	name := s.segmentFile(s.segments[0].seq)
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(content))
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "# ") {
+		return nil, fmt.Errorf("Spool segment %s has no header", name)
+	}
+	header, err := url.ParseQuery(strings.TrimSpace(strings.TrimPrefix(line, "# ")))
+	if err != nil {
+		return nil, fmt.Errorf("Can not parse header of spool segment %s: %s", name, err)
+	}
+	bp, err := influxdbclient.NewBatchPoints(influxdbclient.BatchPointsConfig{
+		Database:         header.Get("database"),
+		RetentionPolicy:  header.Get("retention_policy"),
+		Precision:        header.Get("precision"),
+		WriteConsistency: header.Get("consistency"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid header of spool segment %s: %s", name, err)
+	}
+
+	points, err := models.ParsePoints(content)
+	if err != nil {
+		return nil, fmt.Errorf("Can not parse spool segment %s: %s", name, err)
+	}
+	for _, p := range points {
+		bp.AddPoint(influxdbclient.NewPointFrom(p))
+	}
+	return bp, nil
+}
+
+// removeOldest removes the oldest segment. The index is updated first, so a
+// segment is never replayed twice.
+func (s *spool) removeOldest() error {
+	oldest := s.segments[0]
+	s.segments = s.segments[1:]
+	s.size -= oldest.size
+	err := s.writeIndex()
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(s.dir, s.segmentFile(oldest.seq)))
+}
+
+// spoolBatch stores a batch which could not be written in the spool. It
+// returns the write error if spooling is disabled or fails, so the batch is
+// kept in memory instead.
+func (i *InfluxdbFirehoseNozzle) spoolBatch(bp influxdbclient.BatchPoints, writeErr error) error {
+	if i.spool == nil {
+		return writeErr
+	}
+	err := i.spool.append(bp)
+	if err != nil {
+		i.Log.Errorf("Spooling %d points to disk failed: %v", len(bp.Points()), err)
+		return writeErr
+	}
+	i.Log.Errorf("Writing to InfluxDB failed, spooled %d points to disk: %v", len(bp.Points()), writeErr)
+	return nil
+}
+
+// replaySpool writes the spooled batches in order. Points rejected by
+// InfluxDB are quarantined and the rest of their batch is written. It stops
+// at the first write which fails otherwise, keeping the points in the spool.
+func (i *InfluxdbFirehoseNozzle) replaySpool() error {
+	if i.spool == nil || i.spool.len() == 0 {
+		return nil
+	}
+
+	replayed := 0
+	write := func(bp influxdbclient.BatchPoints) error {
+		err := i.Client.Write(bp)
+		if err != nil {
+			i.countWriteError(err)
+			return err
+		}
+		i.countWrittenPoints(len(bp.Points()))
+		replayed += len(bp.Points())
+		return nil
+	}
+	for i.spool.len() > 0 {
+		bp, err := i.spool.oldest()
+		if err != nil {
+			i.Log.Errorf("Dropping unreadable spool segment: %v", err)
+		} else {
+			err = write(bp)
+			if err != nil && !isRetryableWriteError(err) {
+				bp, err = i.handleRejectedWrite(bp, err, write)
+				if err != nil {
+					replaceErr := i.spool.replaceOldest(bp)
+					if replaceErr != nil {
+						i.Log.Errorf("Replacing spool segment failed: %v", replaceErr)
+					}
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		err = i.spool.removeOldest()
+		if err != nil {
+			i.Log.Errorf("Removing spool segment failed: %v", err)
+			return err
+		}
+	}
+	i.Log.Infof("Replayed %d spooled points", replayed)
+	return nil
+}
@@ -0,0 +1,213 @@
+package influxdbfirehosenozzle
+
+import (
+	"sync/atomic"
+	"time"
+
+	influxdbclient "github.com/influxdata/influxdb/client/v2"
+)
+
+const (
+	defaultWriterCount    = 2
+	defaultWriteQueueSize = 10
+)
+
+// startWriters starts the pool of writer goroutines sending the batches of
+// the write queue to InfluxDB, so slow writes don't block reading from the
+// firehose.
+func (i *InfluxdbFirehoseNozzle) startWriters() {
+	queueSize := int(i.config.WriteQueueSize)
+	if queueSize == 0 {
+		queueSize = defaultWriteQueueSize
+	}
+
+	i.writeQueue = make(chan queuedBatch, queueSize)
+	for w := 0; w < i.writerCount(); w++ {
+		i.writers.Add(1)
+		go func() {
+			defer i.writers.Done()
+			for b := range i.writeQueue {
+				i.writeBatch(b.points)
+				i.finishFlushBatch(b.flush)
+			}
+		}()
+	}
+}
+
+func (i *InfluxdbFirehoseNozzle) writerCount() int {
+	if i.config.WriterCount == 0 {
+		return defaultWriterCount
+	}
+	return int(i.config.WriterCount)
+}
+
+// stopWriters waits for the queued batches to be written. Batches held
+// back because the queue was full are written last, followed by the batches
+// mirrored endpoints missed.
+func (i *InfluxdbFirehoseNozzle) stopWriters() {
+	close(i.writeQueue)
+	i.writers.Wait()
+	for d, b := range i.batches {
+		i.writeBatch(b.points)
+		delete(i.batches, d)
+	}
+	if c, ok := i.Client.(*multiClient); ok {
+		c.finish()
+	}
+}
+
+// queueBatches hands the current batches over to the writers. If the queue
+// is full, the points are kept for the next flush.
+func (i *InfluxdbFirehoseNozzle) queueBatches() {
+	i.mergeRetainedBatches()
+	f := &flush{start: time.Now(), pending: 1}
+	for d, b := range i.batches {
+		atomic.AddInt32(&f.pending, 1)
+		select {
+		case i.writeQueue <- queuedBatch{points: b.points, flush: f}:
+			delete(i.batches, d)
+		default:
+			atomic.AddInt32(&f.pending, -1)
+			i.Log.Warnf("Write queue is full, keeping %d points for the next flush", len(b.points.Points()))
+		}
+	}
+	i.limitBufferedPoints()
+	i.earlyFlushedPoints = 0
+	i.finishFlushBatch(f)
+}
+
+// writeBatch writes a batch, split into batches of the configured size.
+// Points rejected by InfluxDB are quarantined and the rest is resent. If a
+// write fails otherwise, the points of the remaining batches are retained
+// for the next flush.
+func (i *InfluxdbFirehoseNozzle) writeBatch(bp influxdbclient.BatchPoints) {
+	batches := i.splitBatch(bp)
+	for n, batch := range batches {
+		err := i.timedWrite(batch)
+		if err != nil && !isRetryableWriteError(err) {
+			batches[n], err = i.handleRejectedWrite(batch, err, i.timedWrite)
+		}
+		if err == nil {
+			continue
+		}
+
+		retained := 0
+		i.writeLock.Lock()
+		for _, b := range batches[n:] {
+			i.retainedBatches = append(i.retainedBatches, b)
+			retained += len(b.Points())
+		}
+		i.writeLock.Unlock()
+		i.Log.Errorf("Writing to InfluxDB failed, keeping %d points for the next flush: %v", retained, err)
+		return
+	}
+}
+
+// timedWrite writes a batch and records the latency of the write.
+func (i *InfluxdbFirehoseNozzle) timedWrite(bp influxdbclient.BatchPoints) error {
+	atomic.AddInt32(&i.writesInFlight, 1)
+	start := time.Now()
+	err := i.writeOrSpool(bp)
+	latency := time.Since(start)
+	atomic.AddInt32(&i.writesInFlight, -1)
+
+	i.writeLock.Lock()
+	i.writeLatencySum += latency
+	i.writeLatencyCount++
+	if latency > i.writeLatencyMax {
+		i.writeLatencyMax = latency
+	}
+	i.writeLock.Unlock()
+	return err
+}
+
+// writeOrSpool writes a batch after the spooled batches to keep the order.
+// While batches are spooled, the writers take turns replaying, writing and
+// spooling, so no writer writes new points before the spooled ones. If
+// InfluxDB is still unreachable, the batch is spooled as well.
+func (i *InfluxdbFirehoseNozzle) writeOrSpool(bp influxdbclient.BatchPoints) error {
+	i.spoolLock.Lock()
+	if i.spool != nil && i.spool.len() > 0 {
+		defer i.spoolLock.Unlock()
+		err := i.replaySpool()
+		if err == nil {
+			err = i.countedWrite(bp)
+		}
+		if err != nil && isRetryableWriteError(err) {
+			err = i.spoolBatch(bp, err)
+		}
+		return err
+	}
+	i.spoolLock.Unlock()
+
+	err := i.countedWrite(bp)
+	if err != nil && isRetryableWriteError(err) {
+		i.spoolLock.Lock()
+		err = i.spoolBatch(bp, err)
+		i.spoolLock.Unlock()
+	}
+	return err
+}
+
+// countedWrite writes a batch with retries and updates the totals.
+func (i *InfluxdbFirehoseNozzle) countedWrite(bp influxdbclient.BatchPoints) error {
+	err := i.writeWithRetry(bp)
+	if err != nil {
+		i.countWriteError(err)
+		return err
+	}
+	i.countWrittenPoints(len(bp.Points()))
+	return nil
+}
+
+// countWriteError counts a failed write. Setup errors are logged, as
+// nothing is written until the setup is fixed.
+func (i *InfluxdbFirehoseNozzle) countWriteError(err error) {
+	atomic.AddUint64(&i.stats.writeErrors, 1)
+	i.recordError(err)
+	if isSetupError(err) {
+		i.Log.Errorf("InfluxDB rejected the write, check the database or bucket, the credentials and the token: %v", err)
+	}
+}
+
+func (i *InfluxdbFirehoseNozzle) countWrittenPoints(n int) {
+	atomic.AddUint64(&i.stats.pointsWritten, uint64(n))
+	atomic.StoreUint64(&i.stats.lastWriteFlush, atomic.LoadUint64(&i.stats.flushes))
+	atomic.StoreInt32(&i.hasWritten, 1)
+}
+
+// mergeRetainedBatches puts the points of failed writes in front of the
+// current batches of their destinations.
+func (i *InfluxdbFirehoseNozzle) mergeRetainedBatches() {
+	i.writeLock.Lock()
+	retained := i.retainedBatches
+	i.retainedBatches = nil
+	i.writeLock.Unlock()
+
+	for _, r := range retained {
+		d := destinationOf(r)
+		bp := i.newBatchPoints(d)
+		bp.AddPoints(r.Points())
+		if b, ok := i.batches[d]; ok {
+			bp.AddPoints(b.points.Points())
+		}
+		i.batches[d] = i.newBatch(bp)
+	}
+	i.limitBufferedPoints()
+}
+
+// addWriterMetrics adds the write queue depth, the number of writes in
+// flight and the average and maximum write latency since the last flush.
+func (i *InfluxdbFirehoseNozzle) addWriterMetrics() {
+	i.addInternalMetric("writeQueueDepth", uint64(len(i.writeQueue)))
+	i.addInternalMetric("writesInFlight", uint64(atomic.LoadInt32(&i.writesInFlight)))
+
+	i.writeLock.Lock()
+	sum, count, max := i.writeLatencySum, i.writeLatencyCount, i.writeLatencyMax
+	i.writeLatencySum, i.writeLatencyCount, i.writeLatencyMax = 0, 0, 0
+	i.writeLock.Unlock()
+	if count > 0 {
+		i.addInternalMetric("writeLatencyMs", uint64(sum/time.Duration(count)/time.Millisecond))
+		i.addInternalMetric("writeLatencyMaxMs", uint64(max/time.Millisecond))
+	}
+}
@@ -1,19 +1,47 @@
 package influxhelpers
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+
+	"github.com/influxdata/influxdb/models"
 )
 
 type FakeInfluxDB struct {
 	server           *httptest.Server
 	ReceivedContents chan []byte
+
+	lock         sync.Mutex
+	failures     int
+	failureCode  int
+	failureBody  string
+	failedWrites int
+	failedBodies [][]byte
+	v2Token      string
+	v2           bool
+	lastQuery    url.Values
+	queries      []url.Values
+	databases    map[string][]string
+	statements   []string
+	rejectGzip   bool
+	gzipWrites   int
+	conflicts    map[string]string
 }
 
 func NewFakeInfluxDB() *FakeInfluxDB {
 	return &FakeInfluxDB{
 		ReceivedContents: make(chan []byte, 100),
+		databases:        map[string][]string{},
+		conflicts:        map[string]string{},
 	}
 }
 
@@ -22,6 +50,18 @@ func (f *FakeInfluxDB) Start() {
 	f.server.Start()
 }
 
+// Restart starts a closed server again on its previous address.
+func (f *FakeInfluxDB) Restart() {
+	l, err := net.Listen("tcp", f.server.Listener.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.Listener.Close()
+	f.server.Listener = l
+	f.server.Start()
+}
+
 func (f *FakeInfluxDB) Close() {
 	f.server.Close()
 }
@@ -30,10 +70,246 @@ func (f *FakeInfluxDB) URL() string {
 	return f.server.URL
 }
 
+// FailNextWrites answers the next count requests with the given status code
+// and body instead of accepting them.
+func (f *FakeInfluxDB) FailNextWrites(count int, statusCode int, body string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = count
+	f.failureCode = statusCode
+	f.failureBody = body
+}
+
+// UseV2 makes the fake behave like InfluxDB 2.x. It only accepts writes to
+// /api/v2/write with org and bucket parameters and the given token.
+func (f *FakeInfluxDB) UseV2(token string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.v2 = true
+	f.v2Token = token
+}
+
+// RejectGzip makes the fake behave like a server without support for
+// compressed requests, which fails to parse them.
+func (f *FakeInfluxDB) RejectGzip() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rejectGzip = true
+}
+
+// GzipWrites returns the number of accepted gzip compressed requests.
+func (f *FakeInfluxDB) GzipWrites() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.gzipWrites
+}
+
+// ConflictField makes the fake reject writes with a field type conflict if
+// they contain points of the measurement with the field.
+func (f *FakeInfluxDB) ConflictField(measurement, field string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.conflicts[measurement] = field
+}
+
+// conflict returns the error of the first point with a conflicting field.
+func (f *FakeInfluxDB) conflict(contents []byte) string {
+	points, _ := models.ParsePoints(contents)
+	for _, p := range points {
+		field, ok := f.conflicts[p.Name()]
+		if !ok {
+			continue
+		}
+		if _, ok := p.Fields()[field]; ok {
+			msg := fmt.Sprintf("partial write: field type conflict: input field %q on measurement %q is type float, already exists as type integer dropped=1", field, p.Name())
+			body, _ := json.Marshal(map[string]string{"error": msg})
+			return string(body)
+		}
+	}
+	return ""
+}
+
+// LastQuery returns the query parameters of the last request.
+func (f *FakeInfluxDB) LastQuery() url.Values {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastQuery
+}
+
+// Queries returns the query parameters of all requests.
+func (f *FakeInfluxDB) Queries() []url.Values {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]url.Values(nil), f.queries...)
+}
+
+// FailedWrites returns the number of requests answered with an error.
+func (f *FakeInfluxDB) FailedWrites() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.failedWrites
+}
+
+// FailedContents returns the contents of the requests answered with an
+// error.
+func (f *FakeInfluxDB) FailedContents() [][]byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([][]byte(nil), f.failedBodies...)
+}
+
+// AddDatabase adds a database with the given retention policies, as if it
+// had been created before.
+func (f *FakeInfluxDB) AddDatabase(name string, retentionPolicies ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.databases[name] = retentionPolicies
+}
+
+// Statements returns the InfluxQL statements received on /query.
+func (f *FakeInfluxDB) Statements() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.statements...)
+}
+
+var (
+	createDatabase        = regexp.MustCompile(`^CREATE DATABASE "(.*)"$`)
+	showRetentionPolicies = regexp.MustCompile(`^SHOW RETENTION POLICIES ON "(.*)"$`)
+	createRetentionPolicy = regexp.MustCompile(`^CREATE RETENTION POLICY "(.*)" ON "(.*?)" `)
+)
+
+// serveQuery answers the statements needed to create databases and
+// retention policies.
+func (f *FakeInfluxDB) serveQuery(rw http.ResponseWriter, statement string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.statements = append(f.statements, statement)
+
+	result := map[string]interface{}{"statement_id": 0}
+	switch {
+	case statement == "SHOW DATABASES":
+		values := [][]interface{}{}
+		for name := range f.databases {
+			values = append(values, []interface{}{name})
+		}
+		result["series"] = []map[string]interface{}{
+			{"name": "databases", "columns": []string{"name"}, "values": values},
+		}
+	case createDatabase.MatchString(statement):
+		name := createDatabase.FindStringSubmatch(statement)[1]
+		if _, ok := f.databases[name]; !ok {
+			f.databases[name] = []string{"autogen"}
+		}
+	case showRetentionPolicies.MatchString(statement):
+		name := showRetentionPolicies.FindStringSubmatch(statement)[1]
+		policies, ok := f.databases[name]
+		if !ok {
+			result["error"] = "database not found: " + name
+			break
+		}
+		values := [][]interface{}{}
+		for _, rp := range policies {
+			values = append(values, []interface{}{rp, "0s", "168h0m0s", 1, rp == "autogen"})
+		}
+		result["series"] = []map[string]interface{}{
+			{"columns": []string{"name", "duration", "shardGroupDuration", "replicaN", "default"}, "values": values},
+		}
+	case createRetentionPolicy.MatchString(statement):
+		match := createRetentionPolicy.FindStringSubmatch(statement)
+		if _, ok := f.databases[match[2]]; !ok {
+			result["error"] = "database not found: " + match[2]
+			break
+		}
+		f.databases[match[2]] = append(f.databases[match[2]], match[1])
+	default:
+		result["error"] = "unsupported statement: " + statement
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"results": []interface{}{result},
+	})
+}
+
 func (f *FakeInfluxDB) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	contents, _ := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 
+	if r.URL.Path == "/query" {
+		f.serveQuery(rw, r.URL.Query().Get("q"))
+		return
+	}
+
+	compressed := r.Header.Get("Content-Encoding") == "gzip"
+	if compressed {
+		f.lock.Lock()
+		rejectGzip := f.rejectGzip
+		f.lock.Unlock()
+		if rejectGzip {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(`{"error":"unable to parse '\x1f\x8b': invalid field format"}`))
+			return
+		}
+
+		gr, err := gzip.NewReader(bytes.NewReader(contents))
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(`{"error":"` + err.Error() + `"}`))
+			return
+		}
+		contents, _ = ioutil.ReadAll(gr)
+	}
+
+	f.lock.Lock()
+	f.lastQuery = r.URL.Query()
+	f.queries = append(f.queries, f.lastQuery)
+	if f.v2 {
+		if r.URL.Path != "/api/v2/write" {
+			f.lock.Unlock()
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"code":"not found","message":"path not found"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Token "+f.v2Token {
+			f.lock.Unlock()
+			rw.WriteHeader(http.StatusUnauthorized)
+			rw.Write([]byte(`{"code":"unauthorized","message":"unauthorized access"}`))
+			return
+		}
+		if f.lastQuery.Get("org") == "" || f.lastQuery.Get("bucket") == "" {
+			f.lock.Unlock()
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(`{"code":"invalid","message":"org and bucket are required"}`))
+			return
+		}
+	}
+	if conflict := f.conflict(contents); conflict != "" {
+		f.failedWrites++
+		f.failedBodies = append(f.failedBodies, contents)
+		f.lock.Unlock()
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(conflict))
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		f.failedWrites++
+		f.failedBodies = append(f.failedBodies, contents)
+		f.lock.Unlock()
+		rw.WriteHeader(f.failureCode)
+		rw.Write([]byte(f.failureBody))
+		return
+	}
+	v2 := f.v2
+	if compressed {
+		f.gzipWrites++
+	}
+	f.lock.Unlock()
+
+	if v2 {
+		rw.WriteHeader(http.StatusNoContent)
+	}
 	go func() {
 		f.ReceivedContents <- contents
 	}()
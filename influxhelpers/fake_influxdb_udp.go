@@ -0,0 +1,48 @@
+package influxhelpers
+
+import (
+	"net"
+)
+
+// FakeInfluxDBUDP listens for line protocol packets like the UDP service of
+// InfluxDB.
+type FakeInfluxDBUDP struct {
+	conn             *net.UDPConn
+	ReceivedContents chan []byte
+}
+
+func NewFakeInfluxDBUDP() *FakeInfluxDBUDP {
+	return &FakeInfluxDBUDP{
+		ReceivedContents: make(chan []byte, 100),
+	}
+}
+
+func (f *FakeInfluxDBUDP) Start() {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		panic(err)
+	}
+	f.conn = conn
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			contents := make([]byte, n)
+			copy(contents, buf[:n])
+			f.ReceivedContents <- contents
+		}
+	}()
+}
+
+func (f *FakeInfluxDBUDP) Close() {
+	f.conn.Close()
+}
+
+// Addr returns the host:port the fake is listening on.
+func (f *FakeInfluxDBUDP) Addr() string {
+	return f.conn.LocalAddr().String()
+}
@@ -43,10 +43,20 @@ func main() {
 
 	log.Infof("Targeting inluxdb URL: %s \n", config.InfluxDbURL)
 	nozzle := influxdbfirehosenozzle.NewInfluxDBFirehoseNozzle(config, tokenFetcher, log)
+	go stopOnSignal(nozzle)
 	nozzle.Start()
 
 }
 
+// stopOnSignal stops the nozzle on SIGINT or SIGTERM, so it writes the
+// pending points before exiting.
+func stopOnSignal(nozzle *influxdbfirehosenozzle.InfluxdbFirehoseNozzle) {
+	stopChan := make(chan os.Signal, 1)
+	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
+	<-stopChan
+	nozzle.Stop()
+}
+
 func registerGoRoutineDumpSignalChannel() chan os.Signal {
 	threadDumpChan := make(chan os.Signal, 1)
 	signal.Notify(threadDumpChan, syscall.SIGUSR1)
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 )
 
 // NozzleConfig stores configuration of the influx firehose nozzle
@@ -20,14 +22,200 @@ type NozzleConfig struct {
 	InfluxDbUser            string
 	InfluxDbPassword        string
 	InfluxDbAllowSelfSigned bool
+	InfluxDbVersion         string
+	InfluxDbOrg             string
+	InfluxDbBucket          string
+	InfluxDbToken           string
+	InfluxDbUDPAddress      string
+	InfluxDbUDPPayloadSize  uint32
 	FlushDurationSeconds    uint32
 	InsecureSSLSkipVerify   bool
 	MetricPrefix            string
+	MetricPrefixSeparator   string
+	InternalMetricsPrefix   string
+	MeasurementTemplate     string
+	TagTemplates            map[string]string
 	Deployment              string
 	DisableAccessControl    bool
 	IdleTimeoutSeconds      uint32
+	HttpMetrics             string
+	EnableLogMessages       bool
+	LogMessagesMeasurement  string
+	LogMessageMaxBytes      uint32
+	LogMessagesMaxPerFlush  uint32
+	IncludeErrorMessages    bool
+	CounterRates            bool
+	Filters                 []FilterRule
+	RelabelRules            []RelabelRule
+
+	CardinalityWindowSeconds  uint32
+	MaxSeriesPerMeasurement   uint32
+	MaxValuesPerTag           uint32
+	CardinalityOverflowAction string
+
+	RetryMaxAttempts          uint32
+	RetryInitialBackoffMillis uint32
+	RetryMaxBackoffSeconds    uint32
+	MaxBufferedPoints         uint32
+
+	SpoolDirectory    string
+	SpoolMaxMegabytes uint32
+
+	DeadLetterFile         string
+	DeadLetterMaxMegabytes uint32
+
+	WriterCount    uint32
+	WriteQueueSize uint32
+	MaxBatchPoints uint32
+	MaxBatchBytes  uint32
+	GzipWrites     bool
+	GzipLevel      uint32
+
+	RetentionPolicy  string
+	WriteConsistency string
+	Precision        string
+	WriteOverrides   []WriteOverride
+
+	RoutingRules []RoutingRule
+
+	InfluxDbEndpoints []InfluxDbEndpoint
+	EndpointMode      string
+
+	CreateDatabase    bool
+	RetentionPolicies []RetentionPolicy
+
+	SlowConsumerResetSeconds uint32
+
+	HealthBindAddress   string
+	HealthPort          uint32
+	ReadinessMaxFlushes uint32
+}
+
+// RetentionPolicy is created on startup if CreateDatabase is set and the
+// policy doesn't exist. Duration and ShardGroupDuration use the InfluxQL
+// duration syntax, e.g. 30d or 1h, and are checked by Parse. Duration
+// defaults to INF and Replication to 1, InfluxDB chooses the shard group
+// duration if it is empty.
+type RetentionPolicy struct {
+	Name               string
+	Duration           string
+	Replication        uint32
+	ShardGroupDuration string
+	Default            bool
+}
+
+// InfluxDbEndpoint is one of several InfluxDB servers written to instead of
+// InfluxDbURL. Token is used for InfluxDB 2.x.
+type InfluxDbEndpoint struct {
+	URL      string
+	User     string
+	Password string
+	Token    string
+}
+
+// Supported values of EndpointMode.
+const (
+	// EndpointModeFailover writes to the first healthy endpoint.
+	EndpointModeFailover = "failover"
+	// EndpointModeMirror writes every batch to all endpoints.
+	EndpointModeMirror = "mirror"
+)
+
+// RoutingRule writes the points of matching envelopes to another database
+// or retention policy. Field, Tag, Match and Value match like in a
+// FilterRule, except that tag rules match the tags of the point. The first
+// matching rule applies, points matching no rule are written to
+// InfluxDbDatabase.
+type RoutingRule struct {
+	Field           string
+	Tag             string
+	Match           string
+	Value           string
+	Database        string
+	RetentionPolicy string
+}
+
+// WriteOverride changes the retention policy or the precision of points
+// whose measurement matches. Match is one of the FilterRule match types and
+// Measurement the value to match. The first matching override applies.
+type WriteOverride struct {
+	Match           string
+	Measurement     string
+	RetentionPolicy string
+	Precision       string
+}
+
+// Supported values of CardinalityOverflowAction. Tag values exceeding
+// MaxValuesPerTag are collapsed unless the action is CardinalityDrop. New
+// series exceeding MaxSeriesPerMeasurement are always dropped.
+const (
+	CardinalityCollapse = "collapse"
+	CardinalityDrop     = "drop"
+)
+
+// FilterRule drops or keeps envelopes before they are written to InfluxDB.
+// Field is one of origin, name, deployment, job or tag. For tag rules, Tag
+// names the envelope tag to match on. Envelopes matching an exclude rule are
+// dropped. If any include rules are configured, envelopes matching none of
+// them are dropped as well.
+type FilterRule struct {
+	Action string
+	Field  string
+	Tag    string
+	Match  string
+	Value  string
+}
+
+// Supported FilterRule actions. Rules without action exclude envelopes.
+const (
+	FilterInclude = "include"
+	FilterExclude = "exclude"
+)
+
+// RelabelRule rewrites the tags of a point, modeled after Prometheus relabel
+// configs. The values of SourceTags are joined by ";" and matched against
+// Regex, which defaults to "(.*)". Besides tags, __name__ and __origin__ refer
+// to the metric name and origin of the envelope.
+//
+// replace: if Regex matches, TargetTag is set to Replacement, which can
+// reference capture groups as $1 or ${1} and defaults to "$1", and Tags are
+// added to the point.
+// rename: renames the single source tag to TargetTag.
+// drop: removes all SourceTags and, if Regex is set, all tags whose key
+// matches Regex.
+type RelabelRule struct {
+	Action      string
+	SourceTags  []string
+	Regex       string
+	TargetTag   string
+	Replacement string
+	Tags        map[string]string
 }
 
+// Supported RelabelRule actions. Rules without action replace.
+const (
+	RelabelReplace = "replace"
+	RelabelRename  = "rename"
+	RelabelDrop    = "drop"
+)
+
+// Supported FilterRule match types. Rules without match type match exactly.
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchRegex  = "regex"
+)
+
+// Supported values of HttpMetrics. HttpStartStop events are dropped if
+// HttpMetrics is empty.
+const (
+	// HttpMetricsPoints writes one point per HTTP request.
+	HttpMetricsPoints = "points"
+	// HttpMetricsAggregate writes count, sum, min and max of request
+	// durations per app and status class once per flush interval.
+	HttpMetricsAggregate = "aggregate"
+)
+
 // Parse nozzle config file and overwrite values if env variables are set.
 func Parse(configPath string) (*NozzleConfig, error) {
 	configBytes, err := ioutil.ReadFile(configPath)
@@ -52,8 +240,17 @@ func Parse(configPath string) (*NozzleConfig, error) {
 	overrideWithEnvVar("NOZZLE_INFLUXDBUSER", &config.InfluxDbUser)
 	overrideWithEnvVar("NOZZLE_INFLUXDBPASSWORD", &config.InfluxDbPassword)
 	overrideWithEnvBool("NOZZLE_INFLUXDBALLOWSELFSIGNED", &config.InfluxDbAllowSelfSigned)
+	overrideWithEnvVar("NOZZLE_INFLUXDBVERSION", &config.InfluxDbVersion)
+	overrideWithEnvVar("NOZZLE_INFLUXDBORG", &config.InfluxDbOrg)
+	overrideWithEnvVar("NOZZLE_INFLUXDBBUCKET", &config.InfluxDbBucket)
+	overrideWithEnvVar("NOZZLE_INFLUXDBTOKEN", &config.InfluxDbToken)
+	overrideWithEnvVar("NOZZLE_INFLUXDBUDPADDRESS", &config.InfluxDbUDPAddress)
+	overrideWithEnvUint32("NOZZLE_INFLUXDBUDPPAYLOADSIZE", &config.InfluxDbUDPPayloadSize)
 
 	overrideWithEnvVar("NOZZLE_METRICPREFIX", &config.MetricPrefix)
+	overrideWithEnvVar("NOZZLE_METRICPREFIXSEPARATOR", &config.MetricPrefixSeparator)
+	overrideWithEnvVar("NOZZLE_INTERNALMETRICSPREFIX", &config.InternalMetricsPrefix)
+	overrideWithEnvVar("NOZZLE_MEASUREMENTTEMPLATE", &config.MeasurementTemplate)
 	overrideWithEnvVar("NOZZLE_DEPLOYMENT", &config.Deployment)
 
 	overrideWithEnvUint32("NOZZLE_FLUSHDURATIONSECONDS", &config.FlushDurationSeconds)
@@ -61,9 +258,74 @@ func Parse(configPath string) (*NozzleConfig, error) {
 	overrideWithEnvBool("NOZZLE_INSECURESSLSKIPVERIFY", &config.InsecureSSLSkipVerify)
 	overrideWithEnvBool("NOZZLE_DISABLEACCESSCONTROL", &config.DisableAccessControl)
 	overrideWithEnvUint32("NOZZLE_IDLETIMEOUTSECONDS", &config.IdleTimeoutSeconds)
+	overrideWithEnvVar("NOZZLE_HTTPMETRICS", &config.HttpMetrics)
+
+	overrideWithEnvBool("NOZZLE_ENABLELOGMESSAGES", &config.EnableLogMessages)
+	overrideWithEnvVar("NOZZLE_LOGMESSAGESMEASUREMENT", &config.LogMessagesMeasurement)
+	overrideWithEnvUint32("NOZZLE_LOGMESSAGEMAXBYTES", &config.LogMessageMaxBytes)
+	overrideWithEnvUint32("NOZZLE_LOGMESSAGESMAXPERFLUSH", &config.LogMessagesMaxPerFlush)
+	overrideWithEnvBool("NOZZLE_INCLUDEERRORMESSAGES", &config.IncludeErrorMessages)
+	overrideWithEnvBool("NOZZLE_COUNTERRATES", &config.CounterRates)
+
+	overrideWithEnvUint32("NOZZLE_CARDINALITYWINDOWSECONDS", &config.CardinalityWindowSeconds)
+	overrideWithEnvUint32("NOZZLE_MAXSERIESPERMEASUREMENT", &config.MaxSeriesPerMeasurement)
+	overrideWithEnvUint32("NOZZLE_MAXVALUESPERTAG", &config.MaxValuesPerTag)
+	overrideWithEnvVar("NOZZLE_CARDINALITYOVERFLOWACTION", &config.CardinalityOverflowAction)
+
+	overrideWithEnvUint32("NOZZLE_RETRYMAXATTEMPTS", &config.RetryMaxAttempts)
+	overrideWithEnvUint32("NOZZLE_RETRYINITIALBACKOFFMILLIS", &config.RetryInitialBackoffMillis)
+	overrideWithEnvUint32("NOZZLE_RETRYMAXBACKOFFSECONDS", &config.RetryMaxBackoffSeconds)
+	overrideWithEnvUint32("NOZZLE_MAXBUFFEREDPOINTS", &config.MaxBufferedPoints)
+
+	overrideWithEnvVar("NOZZLE_SPOOLDIRECTORY", &config.SpoolDirectory)
+	overrideWithEnvUint32("NOZZLE_SPOOLMAXMEGABYTES", &config.SpoolMaxMegabytes)
+
+	overrideWithEnvVar("NOZZLE_DEADLETTERFILE", &config.DeadLetterFile)
+	overrideWithEnvUint32("NOZZLE_DEADLETTERMAXMEGABYTES", &config.DeadLetterMaxMegabytes)
+
+	overrideWithEnvUint32("NOZZLE_WRITERCOUNT", &config.WriterCount)
+	overrideWithEnvUint32("NOZZLE_WRITEQUEUESIZE", &config.WriteQueueSize)
+	overrideWithEnvUint32("NOZZLE_MAXBATCHPOINTS", &config.MaxBatchPoints)
+	overrideWithEnvUint32("NOZZLE_MAXBATCHBYTES", &config.MaxBatchBytes)
+	overrideWithEnvBool("NOZZLE_GZIPWRITES", &config.GzipWrites)
+	overrideWithEnvUint32("NOZZLE_GZIPLEVEL", &config.GzipLevel)
+
+	overrideWithEnvVar("NOZZLE_RETENTIONPOLICY", &config.RetentionPolicy)
+	overrideWithEnvVar("NOZZLE_WRITECONSISTENCY", &config.WriteConsistency)
+	overrideWithEnvVar("NOZZLE_PRECISION", &config.Precision)
+	overrideWithEnvVar("NOZZLE_ENDPOINTMODE", &config.EndpointMode)
+
+	overrideWithEnvBool("NOZZLE_CREATEDATABASE", &config.CreateDatabase)
+
+	overrideWithEnvUint32("NOZZLE_SLOWCONSUMERRESETSECONDS", &config.SlowConsumerResetSeconds)
+
+	overrideWithEnvVar("NOZZLE_HEALTHBINDADDRESS", &config.HealthBindAddress)
+	overrideWithEnvUint32("NOZZLE_HEALTHPORT", &config.HealthPort)
+	overrideWithEnvUint32("NOZZLE_READINESSMAXFLUSHES", &config.ReadinessMaxFlushes)
+
+	err = validateRetentionPolicies(config.RetentionPolicies)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %s", configPath, err)
+	}
 	return &config, nil
 }
 
+var influxQLDuration = regexp.MustCompile(`^(\d+(ns|u|µ|ms|s|m|h|d|w))+$`)
+
+// validateRetentionPolicies checks the durations, which are pasted into the
+// statements creating the retention policies.
+func validateRetentionPolicies(policies []RetentionPolicy) error {
+	for _, rp := range policies {
+		if rp.Duration != "" && !strings.EqualFold(rp.Duration, "INF") && !influxQLDuration.MatchString(rp.Duration) {
+			return fmt.Errorf("Retention policy %s has an invalid duration %s", rp.Name, rp.Duration)
+		}
+		if rp.ShardGroupDuration != "" && !influxQLDuration.MatchString(rp.ShardGroupDuration) {
+			return fmt.Errorf("Retention policy %s has an invalid shard group duration %s", rp.Name, rp.ShardGroupDuration)
+		}
+	}
+	return nil
+}
+
 func overrideWithEnvVar(name string, value *string) {
 	envValue := os.Getenv(name)
 	if envValue != "" {
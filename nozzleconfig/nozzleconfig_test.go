@@ -1,6 +1,7 @@
 package nozzleconfig_test
 
 import (
+	"io/ioutil"
 	"os"
 
 	"github.com/joek/influxdb-firehose-nozzle/nozzleconfig"
@@ -30,6 +31,129 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.Deployment).To(Equal("deployment-name"))
 		Expect(conf.DisableAccessControl).To(Equal(false))
 		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(60))
+
+		// The example config keeps the default behavior, all other options
+		// are documented in the README.
+		Expect(conf.MeasurementTemplate).To(BeEmpty())
+		Expect(conf.HttpMetrics).To(BeEmpty())
+		Expect(conf.IncludeErrorMessages).To(Equal(false))
+		Expect(conf.Filters).To(BeEmpty())
+		Expect(conf.InfluxDbEndpoints).To(BeEmpty())
+		Expect(conf.HealthPort).To(BeZero())
+	})
+
+	It("successfully parses all options", func() {
+		conf, err := nozzleconfig.Parse("testdata/full-config.json")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.UAAURL).To(Equal("https://uaa.walnut.cf-app.com"))
+		Expect(conf.Username).To(Equal("user"))
+		Expect(conf.Password).To(Equal("user_password"))
+		Expect(conf.InfluxDbURL).To(Equal("https://88.198.249.61:8086"))
+		Expect(conf.InfluxDbDatabase).To(Equal("cloudfoundry"))
+		Expect(conf.InfluxDbUser).To(Equal("cf"))
+		Expect(conf.InfluxDbPassword).To(Equal("cf"))
+		Expect(conf.InfluxDbAllowSelfSigned).To(Equal(true))
+		Expect(conf.InfluxDbVersion).To(Equal("1"))
+		Expect(conf.InfluxDbOrg).To(Equal(""))
+		Expect(conf.InfluxDbBucket).To(Equal(""))
+		Expect(conf.InfluxDbToken).To(Equal(""))
+		Expect(conf.InfluxDbUDPAddress).To(Equal(""))
+		Expect(conf.InfluxDbUDPPayloadSize).To(BeEquivalentTo(512))
+		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(15))
+		Expect(conf.InsecureSSLSkipVerify).To(Equal(true))
+		Expect(conf.MetricPrefix).To(Equal("influxclient"))
+		Expect(conf.MetricPrefixSeparator).To(Equal("."))
+		Expect(conf.InternalMetricsPrefix).To(Equal("influxdb.nozzle"))
+		Expect(conf.MeasurementTemplate).To(Equal("{origin}"))
+		Expect(conf.TagTemplates).To(Equal(map[string]string{"name": "{name}"}))
+		Expect(conf.Deployment).To(Equal("deployment-name"))
+		Expect(conf.DisableAccessControl).To(Equal(false))
+		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(60))
+		Expect(conf.HttpMetrics).To(Equal("aggregate"))
+		Expect(conf.EnableLogMessages).To(Equal(false))
+		Expect(conf.LogMessagesMeasurement).To(Equal("logs"))
+		Expect(conf.LogMessageMaxBytes).To(BeEquivalentTo(4096))
+		Expect(conf.LogMessagesMaxPerFlush).To(BeEquivalentTo(10000))
+		Expect(conf.IncludeErrorMessages).To(Equal(true))
+		Expect(conf.CounterRates).To(Equal(true))
+		Expect(conf.Filters).To(Equal([]nozzleconfig.FilterRule{
+			{Action: "exclude", Field: "name", Match: "prefix", Value: "memstats."},
+		}))
+		Expect(conf.RelabelRules).To(Equal([]nozzleconfig.RelabelRule{
+			{Action: "drop", SourceTags: []string{"ip"}},
+		}))
+		Expect(conf.CardinalityWindowSeconds).To(BeEquivalentTo(3600))
+		Expect(conf.MaxSeriesPerMeasurement).To(BeEquivalentTo(10000))
+		Expect(conf.MaxValuesPerTag).To(BeEquivalentTo(1000))
+		Expect(conf.CardinalityOverflowAction).To(Equal("collapse"))
+		Expect(conf.RetryMaxAttempts).To(BeEquivalentTo(5))
+		Expect(conf.RetryInitialBackoffMillis).To(BeEquivalentTo(500))
+		Expect(conf.RetryMaxBackoffSeconds).To(BeEquivalentTo(30))
+		Expect(conf.MaxBufferedPoints).To(BeEquivalentTo(100000))
+		Expect(conf.SpoolDirectory).To(Equal("/var/vcap/store/influxdb-firehose-nozzle/spool"))
+		Expect(conf.SpoolMaxMegabytes).To(BeEquivalentTo(1024))
+		Expect(conf.DeadLetterFile).To(Equal("/var/vcap/sys/log/influxdb-firehose-nozzle/rejected.lp"))
+		Expect(conf.DeadLetterMaxMegabytes).To(BeEquivalentTo(100))
+		Expect(conf.WriterCount).To(BeEquivalentTo(2))
+		Expect(conf.WriteQueueSize).To(BeEquivalentTo(10))
+		Expect(conf.MaxBatchPoints).To(BeEquivalentTo(5000))
+		Expect(conf.MaxBatchBytes).To(BeEquivalentTo(0))
+		Expect(conf.GzipWrites).To(Equal(true))
+		Expect(conf.GzipLevel).To(BeEquivalentTo(6))
+		Expect(conf.RetentionPolicy).To(Equal("autogen"))
+		Expect(conf.WriteConsistency).To(Equal("any"))
+		Expect(conf.Precision).To(Equal("ms"))
+		Expect(conf.WriteOverrides).To(Equal([]nozzleconfig.WriteOverride{
+			{Match: "regex", Measurement: "ContainerMetric$", RetentionPolicy: "apps"},
+		}))
+		Expect(conf.RoutingRules).To(Equal([]nozzleconfig.RoutingRule{
+			{Field: "tag", Tag: "application_id", Value: "1cc5f1b8-a2f3-4d1c-9d5d-5fe8a6c9c2a4", Database: "tenant-a"},
+		}))
+		Expect(conf.InfluxDbEndpoints).To(Equal([]nozzleconfig.InfluxDbEndpoint{
+			{URL: "https://88.198.249.61:8086", User: "cf", Password: "cf"},
+			{URL: "https://88.198.249.62:8086", User: "cf", Password: "cf"},
+		}))
+		Expect(conf.EndpointMode).To(Equal("mirror"))
+		Expect(conf.CreateDatabase).To(Equal(true))
+		Expect(conf.SlowConsumerResetSeconds).To(BeEquivalentTo(60))
+		Expect(conf.HealthBindAddress).To(Equal("0.0.0.0"))
+		Expect(conf.HealthPort).To(BeEquivalentTo(8080))
+		Expect(conf.ReadinessMaxFlushes).To(BeEquivalentTo(3))
+		Expect(conf.RetentionPolicies).To(Equal([]nozzleconfig.RetentionPolicy{
+			{Name: "apps", Duration: "30d", Replication: 1, ShardGroupDuration: "1d"},
+		}))
+	})
+
+	It("fails to parse invalid retention policy durations", func() {
+		for _, policy := range []string{
+			`{"Name": "apps", "Duration": "30 days"}`,
+			`{"Name": "apps", "Duration": "30d; DROP DATABASE cf"}`,
+			`{"Name": "apps", "Duration": "30d", "ShardGroupDuration": "INF"}`,
+			`{"Name": "apps", "ShardGroupDuration": "1x"}`,
+		} {
+			file, err := ioutil.TempFile("", "nozzleconfig")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.Remove(file.Name())
+			_, err = file.WriteString(`{"RetentionPolicies": [` + policy + `]}`)
+			Expect(err).ToNot(HaveOccurred())
+			file.Close()
+
+			_, err = nozzleconfig.Parse(file.Name())
+			Expect(err).To(MatchError(ContainSubstring("Retention policy apps has an invalid")), policy)
+		}
+	})
+
+	It("successfully parses retention policy durations", func() {
+		file, err := ioutil.TempFile("", "nozzleconfig")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(file.Name())
+		_, err = file.WriteString(`{"RetentionPolicies": [{"Name": "forever", "Duration": "inf"}, {"Name": "apps", "Duration": "1h30m", "ShardGroupDuration": "1w"}]}`)
+		Expect(err).ToNot(HaveOccurred())
+		file.Close()
+
+		conf, err := nozzleconfig.Parse(file.Name())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.RetentionPolicies).To(HaveLen(2))
 	})
 
 	It("successfully overwrites file config values with environmental variables", func() {
@@ -41,14 +165,57 @@ var _ = Describe("NozzleConfig", func() {
 		os.Setenv("NOZZLE_INFLUXDBUSER", "test1")
 		os.Setenv("NOZZLE_INFLUXDBPASSWORD", "test1")
 		os.Setenv("NOZZLE_INFLUXDBALLOWSELFSIGNED", "false")
+		os.Setenv("NOZZLE_INFLUXDBVERSION", "2")
+		os.Setenv("NOZZLE_INFLUXDBORG", "env-org")
+		os.Setenv("NOZZLE_INFLUXDBBUCKET", "env-bucket")
+		os.Setenv("NOZZLE_INFLUXDBTOKEN", "env-token")
+		os.Setenv("NOZZLE_INFLUXDBUDPADDRESS", "1.2.3.4:8089")
+		os.Setenv("NOZZLE_INFLUXDBUDPPAYLOADSIZE", "1400")
 		os.Setenv("NOZZLE_FLUSHDURATIONSECONDS", "25")
 		os.Setenv("NOZZLE_INSECURESSLSKIPVERIFY", "false")
 		os.Setenv("NOZZLE_METRICPREFIX", "env-influxclient")
+		os.Setenv("NOZZLE_METRICPREFIXSEPARATOR", "_")
+		os.Setenv("NOZZLE_INTERNALMETRICSPREFIX", "env-nozzle")
+		os.Setenv("NOZZLE_MEASUREMENTTEMPLATE", "{event_type}")
 		os.Setenv("NOZZLE_DEPLOYMENT", "env-deployment-name")
 		os.Setenv("NOZZLE_DISABLEACCESSCONTROL", "true")
 		os.Setenv("NOZZLE_IDLETIMEOUTSECONDS", "30")
+		os.Setenv("NOZZLE_HTTPMETRICS", "points")
+		os.Setenv("NOZZLE_ENABLELOGMESSAGES", "true")
+		os.Setenv("NOZZLE_LOGMESSAGESMEASUREMENT", "env-logs")
+		os.Setenv("NOZZLE_LOGMESSAGEMAXBYTES", "1024")
+		os.Setenv("NOZZLE_LOGMESSAGESMAXPERFLUSH", "500")
+		os.Setenv("NOZZLE_INCLUDEERRORMESSAGES", "false")
+		os.Setenv("NOZZLE_COUNTERRATES", "false")
+		os.Setenv("NOZZLE_CARDINALITYWINDOWSECONDS", "60")
+		os.Setenv("NOZZLE_MAXSERIESPERMEASUREMENT", "100")
+		os.Setenv("NOZZLE_MAXVALUESPERTAG", "10")
+		os.Setenv("NOZZLE_CARDINALITYOVERFLOWACTION", "drop")
+		os.Setenv("NOZZLE_RETRYMAXATTEMPTS", "3")
+		os.Setenv("NOZZLE_RETRYINITIALBACKOFFMILLIS", "100")
+		os.Setenv("NOZZLE_RETRYMAXBACKOFFSECONDS", "10")
+		os.Setenv("NOZZLE_MAXBUFFEREDPOINTS", "5000")
+		os.Setenv("NOZZLE_SPOOLDIRECTORY", "/tmp/spool")
+		os.Setenv("NOZZLE_SPOOLMAXMEGABYTES", "64")
+		os.Setenv("NOZZLE_DEADLETTERFILE", "/tmp/rejected.lp")
+		os.Setenv("NOZZLE_DEADLETTERMAXMEGABYTES", "10")
+		os.Setenv("NOZZLE_WRITERCOUNT", "8")
+		os.Setenv("NOZZLE_WRITEQUEUESIZE", "100")
+		os.Setenv("NOZZLE_MAXBATCHPOINTS", "1000")
+		os.Setenv("NOZZLE_MAXBATCHBYTES", "1048576")
+		os.Setenv("NOZZLE_GZIPWRITES", "false")
+		os.Setenv("NOZZLE_GZIPLEVEL", "9")
+		os.Setenv("NOZZLE_RETENTIONPOLICY", "short")
+		os.Setenv("NOZZLE_WRITECONSISTENCY", "all")
+		os.Setenv("NOZZLE_PRECISION", "s")
+		os.Setenv("NOZZLE_ENDPOINTMODE", "failover")
+		os.Setenv("NOZZLE_CREATEDATABASE", "false")
+		os.Setenv("NOZZLE_SLOWCONSUMERRESETSECONDS", "300")
+		os.Setenv("NOZZLE_HEALTHBINDADDRESS", "127.0.0.1")
+		os.Setenv("NOZZLE_HEALTHPORT", "9090")
+		os.Setenv("NOZZLE_READINESSMAXFLUSHES", "5")
 
-		conf, err := nozzleconfig.Parse("../config/firehose-nozzle-config.json")
+		conf, err := nozzleconfig.Parse("testdata/full-config.json")
 		Expect(err).ToNot(HaveOccurred())
 		Expect(conf.UAAURL).To(Equal("https://uaa.walnut-env.cf-app.com"))
 		Expect(conf.Username).To(Equal("env-user"))
@@ -58,11 +225,54 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.InfluxDbUser).To(Equal("test1"))
 		Expect(conf.InfluxDbPassword).To(Equal("test1"))
 		Expect(conf.InfluxDbAllowSelfSigned).To(Equal(false))
+		Expect(conf.InfluxDbVersion).To(Equal("2"))
+		Expect(conf.InfluxDbOrg).To(Equal("env-org"))
+		Expect(conf.InfluxDbBucket).To(Equal("env-bucket"))
+		Expect(conf.InfluxDbToken).To(Equal("env-token"))
+		Expect(conf.InfluxDbUDPAddress).To(Equal("1.2.3.4:8089"))
+		Expect(conf.InfluxDbUDPPayloadSize).To(BeEquivalentTo(1400))
 		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(25))
 		Expect(conf.InsecureSSLSkipVerify).To(Equal(false))
 		Expect(conf.MetricPrefix).To(Equal("env-influxclient"))
+		Expect(conf.MetricPrefixSeparator).To(Equal("_"))
+		Expect(conf.InternalMetricsPrefix).To(Equal("env-nozzle"))
+		Expect(conf.MeasurementTemplate).To(Equal("{event_type}"))
 		Expect(conf.Deployment).To(Equal("env-deployment-name"))
 		Expect(conf.DisableAccessControl).To(Equal(true))
 		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(30))
+		Expect(conf.HttpMetrics).To(Equal("points"))
+		Expect(conf.EnableLogMessages).To(Equal(true))
+		Expect(conf.LogMessagesMeasurement).To(Equal("env-logs"))
+		Expect(conf.LogMessageMaxBytes).To(BeEquivalentTo(1024))
+		Expect(conf.LogMessagesMaxPerFlush).To(BeEquivalentTo(500))
+		Expect(conf.IncludeErrorMessages).To(Equal(false))
+		Expect(conf.CounterRates).To(Equal(false))
+		Expect(conf.CardinalityWindowSeconds).To(BeEquivalentTo(60))
+		Expect(conf.MaxSeriesPerMeasurement).To(BeEquivalentTo(100))
+		Expect(conf.MaxValuesPerTag).To(BeEquivalentTo(10))
+		Expect(conf.CardinalityOverflowAction).To(Equal("drop"))
+		Expect(conf.RetryMaxAttempts).To(BeEquivalentTo(3))
+		Expect(conf.RetryInitialBackoffMillis).To(BeEquivalentTo(100))
+		Expect(conf.RetryMaxBackoffSeconds).To(BeEquivalentTo(10))
+		Expect(conf.MaxBufferedPoints).To(BeEquivalentTo(5000))
+		Expect(conf.SpoolDirectory).To(Equal("/tmp/spool"))
+		Expect(conf.SpoolMaxMegabytes).To(BeEquivalentTo(64))
+		Expect(conf.DeadLetterFile).To(Equal("/tmp/rejected.lp"))
+		Expect(conf.DeadLetterMaxMegabytes).To(BeEquivalentTo(10))
+		Expect(conf.WriterCount).To(BeEquivalentTo(8))
+		Expect(conf.WriteQueueSize).To(BeEquivalentTo(100))
+		Expect(conf.MaxBatchPoints).To(BeEquivalentTo(1000))
+		Expect(conf.MaxBatchBytes).To(BeEquivalentTo(1048576))
+		Expect(conf.GzipWrites).To(Equal(false))
+		Expect(conf.GzipLevel).To(BeEquivalentTo(9))
+		Expect(conf.RetentionPolicy).To(Equal("short"))
+		Expect(conf.WriteConsistency).To(Equal("all"))
+		Expect(conf.Precision).To(Equal("s"))
+		Expect(conf.EndpointMode).To(Equal("failover"))
+		Expect(conf.CreateDatabase).To(Equal(false))
+		Expect(conf.SlowConsumerResetSeconds).To(BeEquivalentTo(300))
+		Expect(conf.HealthBindAddress).To(Equal("127.0.0.1"))
+		Expect(conf.HealthPort).To(BeEquivalentTo(9090))
+		Expect(conf.ReadinessMaxFlushes).To(BeEquivalentTo(5))
 	})
 })